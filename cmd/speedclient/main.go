@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/didil/protohackers/speeddaemon/scenario"
+	"go.uber.org/zap"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:3000", "speed daemon server address")
+	scenarioPath := flag.String("scenario", "", "scenario file, a scenario is generated from -cameras, -roads and -cars if empty")
+	numCameras := flag.Int("cameras", 10, "number of cameras of the generated scenario")
+	numRoads := flag.Int("roads", 2, "number of roads of the generated scenario")
+	numCars := flag.Int("cars", 100, "number of cars of the generated scenario")
+	timeout := flag.Duration("timeout", 10*time.Second, "time to wait for the expected tickets")
+	flag.Parse()
+
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		log.Fatalf("logger init failed %v", err)
+	}
+	defer logger.Sync() // flushes buffer, if any
+
+	var sc *scenario.Scenario
+	if *scenarioPath != "" {
+		sc, err = scenario.Load(*scenarioPath)
+	} else {
+		sc, err = scenario.Generate(*numCameras, *numRoads, *numCars)
+	}
+	if err != nil {
+		logger.Fatal("scenario init failed", zap.Error(err))
+	}
+
+	logger.Info("running scenario",
+		zap.String("addr", *addr),
+		zap.Int("roads", len(sc.Roads)),
+		zap.Int("dispatchers", len(sc.Dispatchers)),
+		zap.Int("observations", len(sc.Observations)),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	start := time.Now()
+	tickets, err := scenario.Run(ctx, *addr, sc)
+	if err != nil {
+		logger.Fatal("scenario run failed", zap.Error(err))
+	}
+
+	logger.Info("scenario done", zap.Int("tickets", len(tickets)), zap.Duration("duration", time.Since(start)))
+
+	err = sc.Verify(tickets)
+	if err != nil {
+		logger.Error("scenario verification failed", zap.Error(err))
+		logger.Sync()
+		os.Exit(1)
+	}
+
+	logger.Info("scenario verified")
+}
@@ -0,0 +1,339 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/didil/protohackers/server"
+	"github.com/didil/protohackers/services"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the server settings, loaded from a yaml file
+type Config struct {
+	Listeners   []ListenerConfig  `yaml:"listeners"`
+	Bind        string            `yaml:"bind"`
+	Family      string            `yaml:"family"`
+	Timeouts    TimeoutsConfig    `yaml:"timeouts"`
+	Limits      LimitsConfig      `yaml:"limits"`
+	TLS         TLSConfig         `yaml:"tls"`
+	Metrics     MetricsConfig     `yaml:"metrics"`
+	Chat        ChatConfig        `yaml:"chat"`
+	UD          UDConfig          `yaml:"ud"`
+	Mob         MobConfig         `yaml:"mob"`
+	SpeedDaemon SpeedDaemonConfig `yaml:"speedDaemon"`
+	Logging     LoggingConfig     `yaml:"logging"`
+}
+
+type ListenerConfig struct {
+	Mode string `yaml:"mode"`
+	Port int    `yaml:"port"`
+}
+
+type TimeoutsConfig struct {
+	Drain time.Duration `yaml:"drain"`
+	Idle  time.Duration `yaml:"idle"`
+	Write time.Duration `yaml:"write"`
+}
+
+type LimitsConfig struct {
+	MaxConns      int     `yaml:"maxConns"`
+	MaxConnsPerIP int     `yaml:"maxConnsPerIP"`
+	UDPRate       float64 `yaml:"udpRate"`
+	UDPBurst      int     `yaml:"udpBurst"`
+}
+
+type TLSConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"clientCA"`
+}
+
+type MetricsConfig struct {
+	Addr string `yaml:"addr"`
+}
+
+type ChatConfig struct {
+	MessageLimit   int `yaml:"messageLimit"`
+	ChannelsBuffer int `yaml:"channelsBuffer"`
+	// ReservedNames can't be picked by users, whatever the case
+	ReservedNames []string `yaml:"reservedNames"`
+	// SlowConsumerPolicy is drop-oldest, drop-newest or disconnect
+	SlowConsumerPolicy string `yaml:"slowConsumerPolicy"`
+	// HistorySize is the number of recent messages replayed to users entering a room, 0 disables it
+	HistorySize int `yaml:"historySize"`
+}
+
+type UDConfig struct {
+	MaxContentSize int `yaml:"maxContentSize"`
+	// Workers is the number of datagrams processed at once, the others are dropped
+	Workers int `yaml:"workers"`
+}
+
+type MobConfig struct {
+	UpstreamHost string `yaml:"upstreamHost"`
+	UpstreamPort int    `yaml:"upstreamPort"`
+}
+
+type SpeedDaemonConfig struct {
+	Store string `yaml:"store"`
+}
+
+type LoggingConfig struct {
+	// Level is one of debug, info, warn, error
+	Level string `yaml:"level"`
+	// Format is console or json
+	Format string `yaml:"format"`
+	// AccessLog is a file receiving the connections access log records as json lines,
+	// they go to the server log if empty
+	AccessLog string `yaml:"accessLog"`
+}
+
+// Default returns the settings used when neither the file nor the flags set them
+func Default() *Config {
+	return &Config{
+		Family: string(server.AddressFamilyIPv4),
+		Timeouts: TimeoutsConfig{
+			Drain: server.DefaultDrainTimeout,
+			Write: server.DefaultWriteTimeout,
+		},
+		Limits: LimitsConfig{
+			UDPBurst: 10,
+		},
+		Chat: ChatConfig{
+			MessageLimit:       server.DefaultChatMessageLimit,
+			ChannelsBuffer:     services.DefaultChatChannelsBuffer,
+			SlowConsumerPolicy: string(services.ChatSlowConsumerDropOldest),
+		},
+		UD: UDConfig{
+			MaxContentSize: server.DefaultUDMaxContentSize,
+			Workers:        server.DefaultUDWorkers,
+		},
+		Mob: MobConfig{
+			UpstreamPort: server.DefaultMobUpstreamPort,
+		},
+		Logging: LoggingConfig{
+			Level:  "debug",
+			Format: "console",
+		},
+	}
+}
+
+// Load reads the yaml file at path on top of the default settings
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read config file")
+	}
+
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid config file %s", path)
+	}
+
+	return cfg, nil
+}
+
+// Parse reads yaml data on top of the default settings, unknown fields are rejected
+func Parse(data []byte) (*Config, error) {
+	cfg := Default()
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	err := dec.Decode(cfg)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// ApplyEnv overrides the settings set by environment variables
+func (c *Config) ApplyEnv() {
+	if host := os.Getenv("MOB_UPSTREAM_HOST"); host != "" {
+		c.Mob.UpstreamHost = host
+	}
+}
+
+// Validate reports every invalid setting
+func (c *Config) Validate() error {
+	problems := []string{}
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(c.Listeners) == 0 {
+		addProblem("no listener")
+	}
+	modes := server.RegisteredModes()
+	for i, l := range c.Listeners {
+		if !slices.Contains(modes, server.ProtoHackersMode(l.Mode)) {
+			addProblem("listeners[%d]: invalid mode %q", i, l.Mode)
+		}
+		if l.Port < 0 || l.Port > 65535 {
+			addProblem("listeners[%d]: invalid port %d", i, l.Port)
+		}
+	}
+
+	if c.Mob.UpstreamHost == "" && slices.ContainsFunc(c.Listeners, func(l ListenerConfig) bool {
+		return l.Mode == server.ProtoHackersModeMobInTheMiddle
+	}) {
+		addProblem("mob.upstreamHost: required by the mob listener")
+	}
+
+	switch server.AddressFamily(c.Family) {
+	case server.AddressFamilyIPv4, server.AddressFamilyIPv6, server.AddressFamilyDualStack:
+	default:
+		addProblem("family: invalid address family %q", c.Family)
+	}
+	if c.Bind != "" && net.ParseIP(c.Bind) == nil {
+		addProblem("bind: invalid ip %q", c.Bind)
+	}
+
+	if c.Timeouts.Drain < 0 {
+		addProblem("timeouts.drain: must not be negative")
+	}
+	if c.Timeouts.Idle < 0 {
+		addProblem("timeouts.idle: must not be negative")
+	}
+	if c.Timeouts.Write < 0 {
+		addProblem("timeouts.write: must not be negative")
+	}
+
+	if c.Limits.MaxConns < 0 {
+		addProblem("limits.maxConns: must not be negative")
+	}
+	if c.Limits.MaxConnsPerIP < 0 {
+		addProblem("limits.maxConnsPerIP: must not be negative")
+	}
+	if c.Limits.UDPRate < 0 {
+		addProblem("limits.udpRate: must not be negative")
+	}
+	if c.Limits.UDPRate > 0 && c.Limits.UDPBurst < 1 {
+		addProblem("limits.udpBurst: must be at least 1 when limits.udpRate is set")
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		addProblem("tls: cert and key must be set together")
+	}
+	if c.TLS.ClientCA != "" && c.TLS.Cert == "" {
+		addProblem("tls.clientCA: requires tls.cert and tls.key")
+	}
+
+	if c.Chat.MessageLimit < 1 {
+		addProblem("chat.messageLimit: must be at least 1")
+	}
+	if c.Chat.ChannelsBuffer < 1 {
+		addProblem("chat.channelsBuffer: must be at least 1")
+	}
+	if c.Chat.HistorySize < 0 {
+		addProblem("chat.historySize: must not be negative")
+	}
+	switch services.ChatSlowConsumerPolicy(c.Chat.SlowConsumerPolicy) {
+	case services.ChatSlowConsumerDropOldest, services.ChatSlowConsumerDropNewest, services.ChatSlowConsumerDisconnect:
+	default:
+		addProblem("chat.slowConsumerPolicy: invalid policy %q", c.Chat.SlowConsumerPolicy)
+	}
+	if c.UD.MaxContentSize < 1 || c.UD.MaxContentSize > 65507 {
+		addProblem("ud.maxContentSize: must be between 1 and 65507")
+	}
+	if c.UD.Workers < 1 {
+		addProblem("ud.workers: must be at least 1")
+	}
+	if c.Mob.UpstreamPort < 1 || c.Mob.UpstreamPort > 65535 {
+		addProblem("mob.upstreamPort: invalid port %d", c.Mob.UpstreamPort)
+	}
+
+	if _, err := zapcore.ParseLevel(c.Logging.Level); err != nil {
+		addProblem("logging.level: invalid level %q", c.Logging.Level)
+	}
+	if c.Logging.Format != "console" && c.Logging.Format != "json" {
+		addProblem("logging.format: must be console or json")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// ServerListeners returns the listeners to start
+func (c *Config) ServerListeners() []server.Listener {
+	listeners := make([]server.Listener, 0, len(c.Listeners))
+	for _, l := range c.Listeners {
+		listeners = append(listeners, server.Listener{Mode: server.ProtoHackersMode(l.Mode), Port: l.Port})
+	}
+	return listeners
+}
+
+// ServerOpts returns the server options matching the settings, services excluded
+func (c *Config) ServerOpts() []server.ServerOpt {
+	opts := []server.ServerOpt{
+		server.WithBindAddress(c.Bind),
+		server.WithAddressFamily(server.AddressFamily(c.Family)),
+		server.WithDrainTimeout(c.Timeouts.Drain),
+		server.WithIdleTimeout(c.Timeouts.Idle),
+		server.WithWriteTimeout(c.Timeouts.Write),
+		server.WithMaxConns(c.Limits.MaxConns),
+		server.WithMaxConnsPerIP(c.Limits.MaxConnsPerIP),
+		server.WithUDPRateLimit(c.Limits.UDPRate, c.Limits.UDPBurst),
+		server.WithMetricsAddr(c.Metrics.Addr),
+		server.WithChatMessageLimit(c.Chat.MessageLimit),
+		server.WithUDMaxContentSize(c.UD.MaxContentSize),
+		server.WithUDWorkers(c.UD.Workers),
+		server.WithMobUpstream(c.Mob.UpstreamHost, c.Mob.UpstreamPort),
+	}
+
+	if c.TLS.Cert != "" {
+		opts = append(opts, server.WithTLS(c.TLS.Cert, c.TLS.Key), server.WithTLSClientCA(c.TLS.ClientCA))
+	}
+
+	return opts
+}
+
+// NewLogger builds the logger described by the logging settings
+func (c *Config) NewLogger() (*zap.Logger, error) {
+	level, err := zapcore.ParseLevel(c.Logging.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	zapConfig := zap.NewDevelopmentConfig()
+	if c.Logging.Format == "json" {
+		zapConfig = zap.NewProductionConfig()
+	}
+	zapConfig.Level = zap.NewAtomicLevelAt(level)
+
+	return zapConfig.Build()
+}
+
+// NewAccessLogger builds the logger writing the access log file, nil if no file is set
+func (c *Config) NewAccessLogger() (*zap.Logger, error) {
+	if c.Logging.AccessLog == "" {
+		return nil, nil
+	}
+
+	zapConfig := zap.NewProductionConfig()
+	zapConfig.OutputPaths = []string{c.Logging.AccessLog}
+	zapConfig.Sampling = nil
+	zapConfig.DisableCaller = true
+	zapConfig.DisableStacktrace = true
+
+	logger, err := zapConfig.Build()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open access log")
+	}
+
+	return logger, nil
+}
@@ -0,0 +1,273 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/didil/protohackers/server"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load("testdata/server.yaml")
+	assert.NoError(t, err)
+
+	expected := Default()
+	expected.Listeners = []ListenerConfig{{Mode: "echo", Port: 3000}, {Mode: "mob", Port: 3001}}
+	expected.Bind = "::1"
+	expected.Family = "ipv6"
+	expected.Timeouts.Drain = 5 * time.Second
+	expected.Timeouts.Idle = time.Minute
+	expected.Limits.MaxConns = 100
+	expected.Limits.UDPRate = 50
+	expected.Chat.MessageLimit = 500
+	expected.Chat.ReservedNames = []string{"admin"}
+	expected.Mob.UpstreamHost = "chat.example.com"
+	expected.Logging.Level = "info"
+	expected.Logging.Format = "json"
+
+	assert.Equal(t, expected, cfg)
+	assert.NoError(t, cfg.Validate())
+
+	assert.Equal(t, []server.Listener{
+		{Mode: server.ProtoHackersModeEcho, Port: 3000},
+		{Mode: server.ProtoHackersModeMobInTheMiddle, Port: 3001},
+	}, cfg.ServerListeners())
+}
+
+func TestLoadExample(t *testing.T) {
+	cfg, err := Load("../config.example.yaml")
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Validate())
+
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	_, err = server.NewMultiServer(cfg.ServerListeners(), logger, cfg.ServerOpts()...)
+	assert.NoError(t, err)
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := Load("testdata/missing.yaml")
+	assert.ErrorContains(t, err, "failed to read config file")
+
+	_, err = Parse([]byte("listeners:\n  - mode: echo\n    prot: 3000\n"))
+	assert.ErrorContains(t, err, "field prot not found")
+
+	_, err = Parse([]byte("timeouts:\n  drain: soon\n"))
+	assert.Error(t, err)
+
+	cfg, err := Parse([]byte(""))
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := Parse([]byte(`
+listeners:
+  - mode: chess
+    port: 70000
+  - mode: mob
+    port: 3000
+family: ipv5
+bind: localhost
+timeouts:
+  idle: -1s
+limits:
+  udpRate: 10
+  udpBurst: 0
+tls:
+  clientCA: ca.pem
+chat:
+  messageLimit: 0
+  channelsBuffer: 0
+  slowConsumerPolicy: block
+  historySize: -1
+ud:
+  maxContentSize: 70000
+  workers: 0
+logging:
+  level: loud
+  format: xml
+`))
+	assert.NoError(t, err)
+
+	assert.EqualError(t, cfg.Validate(), "invalid config: "+
+		`listeners[0]: invalid mode "chess", `+
+		"listeners[0]: invalid port 70000, "+
+		"mob.upstreamHost: required by the mob listener, "+
+		`family: invalid address family "ipv5", `+
+		`bind: invalid ip "localhost", `+
+		"timeouts.idle: must not be negative, "+
+		"limits.udpBurst: must be at least 1 when limits.udpRate is set, "+
+		"tls.clientCA: requires tls.cert and tls.key, "+
+		"chat.messageLimit: must be at least 1, "+
+		"chat.channelsBuffer: must be at least 1, "+
+		"chat.historySize: must not be negative, "+
+		`chat.slowConsumerPolicy: invalid policy "block", `+
+		"ud.maxContentSize: must be between 1 and 65507, "+
+		"ud.workers: must be at least 1, "+
+		`logging.level: invalid level "loud", `+
+		"logging.format: must be console or json",
+	)
+
+	cfg = Default()
+	assert.EqualError(t, cfg.Validate(), "invalid config: no listener")
+}
+
+func TestFlagsOverrideFile(t *testing.T) {
+	os.Setenv("MOB_UPSTREAM_HOST", "env.example.com")
+	defer os.Unsetenv("MOB_UPSTREAM_HOST")
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags := NewFlags(fs)
+	err := fs.Parse([]string{
+		"-config", "testdata/server.yaml",
+		"-idle-timeout", "30s",
+		"-max-conns-per-ip", "5",
+		"-log-level", "warn",
+		"-chat-reserved-names", "admin, server,",
+		"-chat-slow-consumer-policy", "disconnect",
+		"-chat-history-size", "20",
+	})
+	assert.NoError(t, err)
+
+	cfg, err := flags.Load()
+	assert.NoError(t, err)
+
+	// flags
+	assert.Equal(t, 30*time.Second, cfg.Timeouts.Idle)
+	assert.Equal(t, 5, cfg.Limits.MaxConnsPerIP)
+	assert.Equal(t, "warn", cfg.Logging.Level)
+	assert.Equal(t, []string{"admin", "server"}, cfg.Chat.ReservedNames)
+	assert.Equal(t, "disconnect", cfg.Chat.SlowConsumerPolicy)
+	assert.Equal(t, 20, cfg.Chat.HistorySize)
+	// env
+	assert.Equal(t, "env.example.com", cfg.Mob.UpstreamHost)
+	// file settings without flags
+	assert.Equal(t, 5*time.Second, cfg.Timeouts.Drain)
+	assert.Equal(t, 100, cfg.Limits.MaxConns)
+	// defaults of unset flags don't override the file
+	assert.Equal(t, "ipv6", cfg.Family)
+	assert.Len(t, cfg.Listeners, 2)
+}
+
+func TestFlagsListeners(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		args     []string
+		expected []ListenerConfig
+	}{
+		{
+			name:     "mode and port",
+			args:     []string{"-m", "echo", "-p", "4000"},
+			expected: []ListenerConfig{{Mode: "echo", Port: 4000}},
+		},
+		{
+			name:     "listeners",
+			args:     []string{"-l", "echo:3000,ud:3000"},
+			expected: []ListenerConfig{{Mode: "echo", Port: 3000}, {Mode: "ud", Port: 3000}},
+		},
+		{
+			name:     "mode overrides the file listeners",
+			file:     "listeners:\n  - mode: echo\n    port: 3000\n  - mode: prime\n    port: 3001\n",
+			args:     []string{"-m", "means"},
+			expected: []ListenerConfig{{Mode: "means", Port: 3000}},
+		},
+		{
+			name:     "port overrides the single file listener",
+			file:     "listeners:\n  - mode: prime\n    port: 3001\n",
+			args:     []string{"-p", "4000"},
+			expected: []ListenerConfig{{Mode: "prime", Port: 4000}},
+		},
+		{
+			name:     "file listeners",
+			file:     "listeners:\n  - mode: prime\n    port: 3001\n",
+			args:     []string{},
+			expected: []ListenerConfig{{Mode: "prime", Port: 3001}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "server.yaml")
+				assert.NoError(t, os.WriteFile(path, []byte(tt.file), 0600))
+				args = append([]string{"-config", path}, args...)
+			}
+
+			fs := flag.NewFlagSet("server", flag.ContinueOnError)
+			flags := NewFlags(fs)
+			assert.NoError(t, fs.Parse(args))
+
+			cfg, err := flags.Load()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, cfg.Listeners)
+		})
+	}
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	flags := NewFlags(fs)
+	assert.NoError(t, fs.Parse([]string{"-l", "echo"}))
+
+	_, err := flags.Load()
+	assert.ErrorContains(t, err, `invalid binding "echo", expected mode:port`)
+
+	fs = flag.NewFlagSet("server", flag.ContinueOnError)
+	flags = NewFlags(fs)
+	assert.NoError(t, fs.Parse([]string{}))
+
+	_, err = flags.Load()
+	assert.EqualError(t, err, `invalid config: listeners[0]: invalid mode ""`)
+
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("listeners:\n  - mode: echo\n    port: 3000\n  - mode: prime\n    port: 3001\n"), 0600))
+
+	fs = flag.NewFlagSet("server", flag.ContinueOnError)
+	flags = NewFlags(fs)
+	assert.NoError(t, fs.Parse([]string{"-config", path, "-p", "4000"}))
+
+	_, err = flags.Load()
+	assert.EqualError(t, err, "-p can't pick among the 2 config file listeners, use -m with -p or -l")
+}
+
+func TestNewLogger(t *testing.T) {
+	cfg := Default()
+	cfg.Logging.Level = "warn"
+	cfg.Logging.Format = "json"
+
+	logger, err := cfg.NewLogger()
+	assert.NoError(t, err)
+	assert.False(t, logger.Core().Enabled(zap.InfoLevel))
+	assert.True(t, logger.Core().Enabled(zap.WarnLevel))
+}
+
+func TestNewAccessLogger(t *testing.T) {
+	cfg := Default()
+
+	accessLogger, err := cfg.NewAccessLogger()
+	assert.NoError(t, err)
+	assert.Nil(t, accessLogger)
+
+	cfg.Logging.AccessLog = filepath.Join(t.TempDir(), "access.log")
+
+	accessLogger, err = cfg.NewAccessLogger()
+	assert.NoError(t, err)
+
+	accessLogger.Info("connection closed", zap.String("mode", "echo"))
+	accessLogger.Sync()
+
+	data, err := os.ReadFile(cfg.Logging.AccessLog)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"msg":"connection closed","mode":"echo"}`)
+
+	cfg.Logging.AccessLog = filepath.Join(t.TempDir(), "missing", "access.log")
+	_, err = cfg.NewAccessLogger()
+	assert.ErrorContains(t, err, "failed to open access log")
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/didil/protohackers/server"
+)
+
+// Flags are the command line flags, they override the config file settings when set
+type Flags struct {
+	fs         *flag.FlagSet
+	configPath *string
+	mode       *string
+	port       *int
+	listeners  *string
+	// values holds the settings parsed from the flags
+	values *Config
+	// overrides copies the value of a flag into the config, indexed by flag name
+	overrides map[string]func(c *Config)
+}
+
+// NewFlags registers the flags on fs, their defaults are the default settings
+func NewFlags(fs *flag.FlagSet) *Flags {
+	d := Default()
+	v := &Config{}
+
+	f := &Flags{
+		fs:         fs,
+		configPath: fs.String("config", "", "yaml config file, flags and environment variables override its settings"),
+		mode:       fs.String("m", "", "protohackers mode"),
+		port:       fs.Int("p", 3000, "port to listen to"),
+		listeners:  fs.String("l", "", "comma separated mode:port listeners, e.g. echo:3000,ud:3001, overrides -m and -p"),
+		values:     v,
+		overrides:  map[string]func(c *Config){},
+	}
+
+	fs.StringVar(&v.Bind, "bind", d.Bind, "ip the listeners bind, all interfaces if empty")
+	f.override("bind", func(c *Config) { c.Bind = v.Bind })
+
+	fs.StringVar(&v.Family, "family", d.Family, "ip versions accepted by the listeners: ipv4, ipv6 or dual")
+	f.override("family", func(c *Config) { c.Family = v.Family })
+
+	fs.DurationVar(&v.Timeouts.Drain, "drain-timeout", d.Timeouts.Drain, "time given to connections to end on shutdown before they are closed")
+	f.override("drain-timeout", func(c *Config) { c.Timeouts.Drain = v.Timeouts.Drain })
+
+	fs.DurationVar(&v.Timeouts.Idle, "idle-timeout", d.Timeouts.Idle, "close connections idle for that long, 0 disables it")
+	f.override("idle-timeout", func(c *Config) { c.Timeouts.Idle = v.Timeouts.Idle })
+
+	fs.DurationVar(&v.Timeouts.Write, "write-timeout", d.Timeouts.Write, "close connections whose writes block for that long, 0 disables it")
+	f.override("write-timeout", func(c *Config) { c.Timeouts.Write = v.Timeouts.Write })
+
+	fs.IntVar(&v.Limits.MaxConns, "max-conns", d.Limits.MaxConns, "maximum number of concurrent tcp connections, 0 means no limit")
+	f.override("max-conns", func(c *Config) { c.Limits.MaxConns = v.Limits.MaxConns })
+
+	fs.IntVar(&v.Limits.MaxConnsPerIP, "max-conns-per-ip", d.Limits.MaxConnsPerIP, "maximum number of concurrent tcp connections from a single ip, 0 means no limit")
+	f.override("max-conns-per-ip", func(c *Config) { c.Limits.MaxConnsPerIP = v.Limits.MaxConnsPerIP })
+
+	fs.Float64Var(&v.Limits.UDPRate, "udp-rate", d.Limits.UDPRate, "datagrams per second accepted from a single ip, 0 means no limit")
+	f.override("udp-rate", func(c *Config) { c.Limits.UDPRate = v.Limits.UDPRate })
+
+	fs.IntVar(&v.Limits.UDPBurst, "udp-burst", d.Limits.UDPBurst, "datagrams accepted at once from a single ip when -udp-rate is set")
+	f.override("udp-burst", func(c *Config) { c.Limits.UDPBurst = v.Limits.UDPBurst })
+
+	fs.IntVar(&v.UD.Workers, "ud-workers", d.UD.Workers, "unusual database datagrams processed at once, the others are dropped")
+	f.override("ud-workers", func(c *Config) { c.UD.Workers = v.UD.Workers })
+
+	fs.StringVar(&v.Metrics.Addr, "metrics-addr", d.Metrics.Addr, "address serving prometheus metrics at /metrics, e.g. :9100, disabled if empty")
+	f.override("metrics-addr", func(c *Config) { c.Metrics.Addr = v.Metrics.Addr })
+
+	fs.StringVar(&v.TLS.Cert, "tls-cert", d.TLS.Cert, "tls certificate file, tcp modes are served over tls if set, reloaded on SIGHUP")
+	f.override("tls-cert", func(c *Config) { c.TLS.Cert = v.TLS.Cert })
+
+	fs.StringVar(&v.TLS.Key, "tls-key", d.TLS.Key, "tls private key file, reloaded on SIGHUP")
+	f.override("tls-key", func(c *Config) { c.TLS.Key = v.TLS.Key })
+
+	fs.StringVar(&v.TLS.ClientCA, "tls-client-ca", d.TLS.ClientCA, "ca file verifying tls client certificates, client certificates are required if set")
+	f.override("tls-client-ca", func(c *Config) { c.TLS.ClientCA = v.TLS.ClientCA })
+
+	fs.Func("chat-reserved-names", "comma separated names budget chat users can't pick", func(names string) error {
+		v.Chat.ReservedNames = splitList(names)
+		return nil
+	})
+	f.override("chat-reserved-names", func(c *Config) { c.Chat.ReservedNames = v.Chat.ReservedNames })
+
+	fs.StringVar(&v.Chat.SlowConsumerPolicy, "chat-slow-consumer-policy", d.Chat.SlowConsumerPolicy, "what happens to budget chat messages for users whose queue is full: drop-oldest, drop-newest or disconnect")
+	f.override("chat-slow-consumer-policy", func(c *Config) { c.Chat.SlowConsumerPolicy = v.Chat.SlowConsumerPolicy })
+
+	fs.IntVar(&v.Chat.HistorySize, "chat-history-size", d.Chat.HistorySize, "number of recent budget chat messages replayed to users entering a room, 0 disables it")
+	f.override("chat-history-size", func(c *Config) { c.Chat.HistorySize = v.Chat.HistorySize })
+
+	fs.StringVar(&v.SpeedDaemon.Store, "speed-daemon-store", d.SpeedDaemon.Store, "speed daemon state file, state is kept in memory only if empty")
+	f.override("speed-daemon-store", func(c *Config) { c.SpeedDaemon.Store = v.SpeedDaemon.Store })
+
+	fs.StringVar(&v.Logging.Level, "log-level", d.Logging.Level, "log level: debug, info, warn or error")
+	f.override("log-level", func(c *Config) { c.Logging.Level = v.Logging.Level })
+
+	fs.StringVar(&v.Logging.Format, "log-format", d.Logging.Format, "log format: console or json")
+	f.override("log-format", func(c *Config) { c.Logging.Format = v.Logging.Format })
+
+	fs.StringVar(&v.Logging.AccessLog, "access-log", d.Logging.AccessLog, "file receiving the connections access log as json lines, the server log is used if empty")
+	f.override("access-log", func(c *Config) { c.Logging.AccessLog = v.Logging.AccessLog })
+
+	return f
+}
+
+// splitList splits a comma separated flag value, ignoring empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func (f *Flags) override(name string, apply func(c *Config)) {
+	f.overrides[name] = apply
+}
+
+// ConfigPath returns the config file path, empty if none was given
+func (f *Flags) ConfigPath() string {
+	return *f.configPath
+}
+
+// Apply overrides the settings of c with the flags set on the command line
+func (f *Flags) Apply(c *Config) error {
+	set := map[string]bool{}
+	f.fs.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	for name := range set {
+		if apply, ok := f.overrides[name]; ok {
+			apply(c)
+		}
+	}
+
+	if set["l"] {
+		listeners, err := server.ParseListeners(*f.listeners)
+		if err != nil {
+			return err
+		}
+
+		c.Listeners = make([]ListenerConfig, 0, len(listeners))
+		for _, l := range listeners {
+			c.Listeners = append(c.Listeners, ListenerConfig{Mode: string(l.Mode), Port: l.Port})
+		}
+	} else if set["m"] || len(c.Listeners) == 0 {
+		c.Listeners = []ListenerConfig{{Mode: *f.mode, Port: *f.port}}
+	} else if set["p"] {
+		// with several listeners there's no telling which port -p is meant for
+		if len(c.Listeners) > 1 {
+			return fmt.Errorf("-p can't pick among the %d config file listeners, use -m with -p or -l", len(c.Listeners))
+		}
+		c.Listeners[0].Port = *f.port
+	}
+
+	return nil
+}
+
+// Load reads the config file if one was given, then applies the environment variables and the flags,
+// and validates the result
+func (f *Flags) Load() (*Config, error) {
+	cfg := Default()
+	if f.ConfigPath() != "" {
+		var err error
+		cfg, err = Load(f.ConfigPath())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.ApplyEnv()
+
+	err := f.Apply(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
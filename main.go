@@ -7,33 +7,89 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/didil/protohackers/config"
+	"github.com/didil/protohackers/metrics"
 	"github.com/didil/protohackers/server"
 	"github.com/didil/protohackers/services"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
 func main() {
-	mode := flag.String("m", "", "protohackers mode")
-	port := flag.Int("p", 3000, "port to listen to")
+	flags := config.NewFlags(flag.CommandLine)
 	flag.Parse()
 
-	logger, err := zap.NewDevelopment()
+	cfg, err := flags.Load()
 	if err != nil {
-		log.Fatalf("logger init failed %v", err)
+		log.Fatalf("config error: %v", err)
+	}
+
+	err = run(cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// run serves until a termination signal is received, the deferred calls close the store and flush the logs
+// before the program exits
+func run(cfg *config.Config) error {
+	logger, err := cfg.NewLogger()
+	if err != nil {
+		return errors.Wrapf(err, "logger init failed")
 	}
 	defer logger.Sync() // flushes buffer, if any
 
-	chatSvc := services.NewChatService(logger)
+	accessLogger, err := cfg.NewAccessLogger()
+	if err != nil {
+		return errors.Wrapf(err, "access log init failed")
+	}
+	if accessLogger != nil {
+		defer accessLogger.Sync()
+	}
+
+	metricsRegistry := metrics.NewRegistry()
+
+	chatSvc := services.NewChatService(logger,
+		services.WithChatChannelsBuffer(cfg.Chat.ChannelsBuffer),
+		services.WithChatReservedNames(cfg.Chat.ReservedNames...),
+		services.WithChatSlowConsumerPolicy(services.ChatSlowConsumerPolicy(cfg.Chat.SlowConsumerPolicy)),
+		services.WithChatHistorySize(cfg.Chat.HistorySize),
+		services.WithChatMetrics(metricsRegistry),
+	)
 	unusualDbSvc := services.NewUnusualDbService()
-	speedDaemonSvc := services.NewSpeedDaemonService()
+	speedDaemonStore := services.NewNopSpeedDaemonStore()
+	if cfg.SpeedDaemon.Store != "" {
+		speedDaemonStore, err = services.NewFileSpeedDaemonStore(cfg.SpeedDaemon.Store)
+		if err != nil {
+			return errors.Wrapf(err, "speed daemon store init failed")
+		}
+	}
+	defer func() {
+		err := speedDaemonStore.Close()
+		if err != nil {
+			logger.Error("speed daemon store close failed", zap.Error(err))
+		}
+	}()
+
+	speedDaemonSvc := services.NewSpeedDaemonService(
+		services.WithSpeedDaemonStore(speedDaemonStore),
+		services.WithSpeedDaemonLogger(logger),
+		services.WithSpeedDaemonMetrics(metricsRegistry),
+	)
 
-	s, err := server.NewServer(*mode, *port, logger,
+	opts := append(cfg.ServerOpts(),
 		server.WithChatService(chatSvc),
 		server.WithUnusualDbService(unusualDbSvc),
 		server.WithSpeedDaemonDbService(speedDaemonSvc),
+		server.WithMetricsRegistry(metricsRegistry),
 	)
+	if accessLogger != nil {
+		opts = append(opts, server.WithAccessLogger(accessLogger))
+	}
+
+	s, err := server.NewMultiServer(cfg.ServerListeners(), logger, opts...)
 	if err != nil {
-		logger.Fatal("server init failed", zap.Error(err))
+		return errors.Wrapf(err, "server init failed")
 	}
 
 	sigs := make(chan os.Signal, 1)
@@ -47,10 +103,24 @@ func main() {
 		close(done)
 	}()
 
+	if cfg.TLS.Cert != "" {
+		reloadSigs := make(chan os.Signal, 1)
+		signal.Notify(reloadSigs, syscall.SIGHUP)
+
+		go func() {
+			for range reloadSigs {
+				err := s.ReloadTLS()
+				if err != nil {
+					logger.Error("tls reload failed", zap.Error(err))
+				}
+			}
+		}()
+	}
+
 	err = s.Start(done)
 	if err != nil {
-		logger.Fatal("server start error", zap.Error(err))
+		return errors.Wrapf(err, "server start error")
 	}
 
-	os.Exit(0)
+	return nil
 }
@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metricType string
+
+const (
+	metricTypeCounter metricType = "counter"
+	metricTypeGauge   metricType = "gauge"
+)
+
+// Registry holds metrics and writes them in the prometheus text format
+type Registry struct {
+	metrics []*metric
+	names   map[string]bool
+	lock    *sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: map[string]bool{},
+		lock:  &sync.Mutex{},
+	}
+}
+
+type metric struct {
+	name       string
+	help       string
+	typ        metricType
+	labelNames []string
+	// series values by joined label values
+	series map[string]*series
+	// valueFunc computes the value of unlabelled metrics when they are written
+	valueFunc func() float64
+	lock      *sync.Mutex
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+func (r *Registry) register(name string, help string, typ metricType, labelNames []string, valueFunc func() float64) *metric {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.names[name] {
+		panic(fmt.Sprintf("metric already registered: %s", name))
+	}
+	r.names[name] = true
+
+	m := &metric{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		series:     map[string]*series{},
+		valueFunc:  valueFunc,
+		lock:       &sync.Mutex{},
+	}
+	r.metrics = append(r.metrics, m)
+
+	return m
+}
+
+// add adds v to the series identified by labelValues
+func (m *metric) add(v float64, labelValues []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.getSeries(labelValues).value += v
+}
+
+func (m *metric) set(v float64, labelValues []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.getSeries(labelValues).value = v
+}
+
+func (m *metric) get(labelValues []string) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, ok := m.series[strings.Join(labelValues, "\xff")]
+	if !ok {
+		return 0
+	}
+	return s.value
+}
+
+// getSeries must be called with the lock held
+func (m *metric) getSeries(labelValues []string) *series {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		m.series[key] = s
+	}
+
+	return s
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+
+	if m.valueFunc != nil {
+		fmt.Fprintf(w, "%s %s\n", m.name, formatValue(m.valueFunc()))
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labelNames, s.labelValues), formatValue(s.value))
+	}
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	m *metric
+}
+
+// NewCounter registers a counter, its series are identified by the values of labelNames
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{m: r.register(name, help, metricTypeCounter, labelNames, nil)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.m.add(1, labelValues)
+}
+
+// Add increases the counter by v, negative values are ignored
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	c.m.add(v, labelValues)
+}
+
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.m.get(labelValues)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	m *metric
+}
+
+// NewGauge registers a gauge, its series are identified by the values of labelNames
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	return &Gauge{m: r.register(name, help, metricTypeGauge, labelNames, nil)}
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by f every time metrics are written
+func (r *Registry) NewGaugeFunc(name string, help string, f func() float64) {
+	r.register(name, help, metricTypeGauge, nil, f)
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.m.add(1, labelValues)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.m.add(-1, labelValues)
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.set(v, labelValues)
+}
+
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.m.get(labelValues)
+}
+
+// Write writes every metric in the prometheus text format, in registration order
+func (r *Registry) Write(out io.Writer) error {
+	r.lock.Lock()
+	metrics := append([]*metric{}, r.metrics...)
+	r.lock.Unlock()
+
+	w := bufio.NewWriter(out)
+	for _, m := range metrics {
+		m.write(w)
+	}
+
+	return w.Flush()
+}
+
+// Handler serves the metrics over http
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
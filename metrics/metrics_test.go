@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+
+	conns := r.NewGauge("active_connections", "Active connections.", "mode")
+	bytesRead := r.NewCounter("bytes_read_total", "Bytes read.", "mode", "transport")
+	r.NewGaugeFunc("keys", "Stored keys.", func() float64 { return 3 })
+
+	conns.Inc("echo")
+	conns.Inc("echo")
+	conns.Inc("prime")
+	conns.Dec("echo")
+	bytesRead.Add(10, "mob", "tcp")
+	bytesRead.Add(5, "mob", "tcp")
+	bytesRead.Add(-5, "mob", "tcp")
+	bytesRead.Inc("say \"hi\"\n", "udp")
+
+	assert.Equal(t, float64(1), conns.Value("echo"))
+	assert.Equal(t, float64(15), bytesRead.Value("mob", "tcp"))
+	assert.Equal(t, float64(0), bytesRead.Value("echo", "tcp"))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, r.Write(buf))
+	assert.Equal(t, `# HELP active_connections Active connections.
+# TYPE active_connections gauge
+active_connections{mode="echo"} 1
+active_connections{mode="prime"} 1
+# HELP bytes_read_total Bytes read.
+# TYPE bytes_read_total counter
+bytes_read_total{mode="mob",transport="tcp"} 15
+bytes_read_total{mode="say \"hi\"\n",transport="udp"} 1
+# HELP keys Stored keys.
+# TYPE keys gauge
+keys 3
+`, buf.String())
+}
+
+func TestRegistryPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests.", "mode")
+
+	assert.PanicsWithValue(t, "metric already registered: requests_total", func() {
+		r.NewGauge("requests_total", "Requests.")
+	})
+	assert.PanicsWithValue(t, "metric requests_total expects 1 label values, got 0", func() {
+		c.Inc()
+	})
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	resp := rec.Result()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "requests_total 1\n")
+}
@@ -7,6 +7,7 @@ package mocks
 import (
 	reflect "reflect"
 
+	services "github.com/didil/protohackers/services"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -34,12 +35,14 @@ func (m *MockChatService) EXPECT() *MockChatServiceMockRecorder {
 }
 
 // AddUser mocks base method.
-func (m *MockChatService) AddUser(name string) (int, chan string) {
+func (m *MockChatService) AddUser(name string) (int, chan string, services.ChatRoomSnapshot, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "AddUser", name)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(chan string)
-	return ret0, ret1
+	ret2, _ := ret[2].(services.ChatRoomSnapshot)
+	ret3, _ := ret[3].(error)
+	return ret0, ret1, ret2, ret3
 }
 
 // AddUser indicates an expected call of AddUser.
@@ -49,15 +52,15 @@ func (mr *MockChatServiceMockRecorder) AddUser(name interface{}) *gomock.Call {
 }
 
 // Broadcast mocks base method.
-func (m *MockChatService) Broadcast(userId int, event string) {
+func (m *MockChatService) Broadcast(room string, userId int, event string) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "Broadcast", userId, event)
+	m.ctrl.Call(m, "Broadcast", room, userId, event)
 }
 
 // Broadcast indicates an expected call of Broadcast.
-func (mr *MockChatServiceMockRecorder) Broadcast(userId, event interface{}) *gomock.Call {
+func (mr *MockChatServiceMockRecorder) Broadcast(room, userId, event interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Broadcast", reflect.TypeOf((*MockChatService)(nil).Broadcast), userId, event)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Broadcast", reflect.TypeOf((*MockChatService)(nil).Broadcast), room, userId, event)
 }
 
 // IsValidName mocks base method.
@@ -74,6 +77,36 @@ func (mr *MockChatServiceMockRecorder) IsValidName(name interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsValidName", reflect.TypeOf((*MockChatService)(nil).IsValidName), name)
 }
 
+// IsValidRoomName mocks base method.
+func (m *MockChatService) IsValidRoomName(room string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsValidRoomName", room)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsValidRoomName indicates an expected call of IsValidRoomName.
+func (mr *MockChatServiceMockRecorder) IsValidRoomName(room interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsValidRoomName", reflect.TypeOf((*MockChatService)(nil).IsValidRoomName), room)
+}
+
+// JoinRoom mocks base method.
+func (m *MockChatService) JoinRoom(id int, room string) (string, services.ChatRoomSnapshot, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "JoinRoom", id, room)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(services.ChatRoomSnapshot)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// JoinRoom indicates an expected call of JoinRoom.
+func (mr *MockChatServiceMockRecorder) JoinRoom(id, room interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "JoinRoom", reflect.TypeOf((*MockChatService)(nil).JoinRoom), id, room)
+}
+
 // ListCurrentUsersNames mocks base method.
 func (m *MockChatService) ListCurrentUsersNames() []string {
 	m.ctrl.T.Helper()
@@ -88,10 +121,53 @@ func (mr *MockChatServiceMockRecorder) ListCurrentUsersNames() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListCurrentUsersNames", reflect.TypeOf((*MockChatService)(nil).ListCurrentUsersNames))
 }
 
+// ListRoomUsersNames mocks base method.
+func (m *MockChatService) ListRoomUsersNames(room string) []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListRoomUsersNames", room)
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// ListRoomUsersNames indicates an expected call of ListRoomUsersNames.
+func (mr *MockChatServiceMockRecorder) ListRoomUsersNames(room interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListRoomUsersNames", reflect.TypeOf((*MockChatService)(nil).ListRoomUsersNames), room)
+}
+
+// ListRooms mocks base method.
+func (m *MockChatService) ListRooms() []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListRooms")
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// ListRooms indicates an expected call of ListRooms.
+func (mr *MockChatServiceMockRecorder) ListRooms() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListRooms", reflect.TypeOf((*MockChatService)(nil).ListRooms))
+}
+
+// Post mocks base method.
+func (m *MockChatService) Post(room string, userId int, msg string) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "Post", room, userId, msg)
+}
+
+// Post indicates an expected call of Post.
+func (mr *MockChatServiceMockRecorder) Post(room, userId, msg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Post", reflect.TypeOf((*MockChatService)(nil).Post), room, userId, msg)
+}
+
 // RemoveUser mocks base method.
-func (m *MockChatService) RemoveUser(id int) {
+func (m *MockChatService) RemoveUser(id int) (string, bool) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "RemoveUser", id)
+	ret := m.ctrl.Call(m, "RemoveUser", id)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
 }
 
 // RemoveUser indicates an expected call of RemoveUser.
@@ -99,3 +175,17 @@ func (mr *MockChatServiceMockRecorder) RemoveUser(id interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveUser", reflect.TypeOf((*MockChatService)(nil).RemoveUser), id)
 }
+
+// SendTo mocks base method.
+func (m *MockChatService) SendTo(name, msg string) bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SendTo", name, msg)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// SendTo indicates an expected call of SendTo.
+func (mr *MockChatServiceMockRecorder) SendTo(name, msg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SendTo", reflect.TypeOf((*MockChatService)(nil).SendTo), name, msg)
+}
@@ -47,6 +47,20 @@ func (mr *MockUnusualDbServiceMockRecorder) Get(key interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockUnusualDbService)(nil).Get), key)
 }
 
+// Len mocks base method.
+func (m *MockUnusualDbService) Len() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Len")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// Len indicates an expected call of Len.
+func (mr *MockUnusualDbServiceMockRecorder) Len() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Len", reflect.TypeOf((*MockUnusualDbService)(nil).Len))
+}
+
 // Set mocks base method.
 func (m *MockUnusualDbService) Set(key, value string) {
 	m.ctrl.T.Helper()
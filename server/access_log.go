@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// close reasons of the access log records
+const (
+	closeReasonClientClosed   = "client closed"
+	closeReasonServerShutdown = "server shutdown"
+	closeReasonIdleTimeout    = "idle timeout"
+	closeReasonWriteTimeout   = "write timeout"
+	closeReasonServerClosed   = "server closed"
+)
+
+var connStatsContextKey ContextKey = "conn-stats"
+
+// connStats collects the figures of the access log record of a connection,
+// its methods can be called on a nil *connStats when the handler runs outside of HandleTCPConn
+type connStats struct {
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	messagesIn   atomic.Int64
+	messagesOut  atomic.Int64
+	lock         *sync.Mutex
+	// first read and write errors seen on the connection
+	readErr  error
+	writeErr error
+	// closeReason is set by handlers ending the connection on a protocol error
+	closeReason string
+}
+
+func newConnStats() *connStats {
+	return &connStats{lock: &sync.Mutex{}}
+}
+
+func connStatsFromContext(ctx context.Context) *connStats {
+	stats, _ := ctx.Value(connStatsContextKey).(*connStats)
+	return stats
+}
+
+// messageIn counts a message received from the client
+func (st *connStats) messageIn() {
+	if st == nil {
+		return
+	}
+	st.messagesIn.Add(1)
+}
+
+// messageOut counts a message sent to the client
+func (st *connStats) messageOut() {
+	if st == nil {
+		return
+	}
+	st.messagesOut.Add(1)
+}
+
+// setCloseReason records why the handler ended the connection, the first reason is kept
+func (st *connStats) setCloseReason(reason string) {
+	if st == nil {
+		return
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.closeReason == "" {
+		st.closeReason = reason
+	}
+}
+
+func (st *connStats) recordRead(n int, err error) {
+	st.bytesRead.Add(int64(n))
+	if err == nil {
+		return
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.readErr == nil {
+		st.readErr = err
+	}
+}
+
+func (st *connStats) recordWrite(n int, err error) {
+	st.bytesWritten.Add(int64(n))
+	if err == nil {
+		return
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.writeErr == nil {
+		st.writeErr = err
+	}
+}
+
+// reason returns why the connection ended, serverCtx is cancelled when the server shuts down
+func (st *connStats) reason(serverCtx context.Context) string {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	switch {
+	case st.closeReason != "":
+		return st.closeReason
+	case serverCtx.Err() != nil:
+		return closeReasonServerShutdown
+	case errors.Is(st.writeErr, os.ErrDeadlineExceeded):
+		return closeReasonWriteTimeout
+	case errors.Is(st.readErr, os.ErrDeadlineExceeded):
+		return closeReasonIdleTimeout
+	case errors.Is(st.readErr, io.EOF):
+		return closeReasonClientClosed
+	case st.writeErr != nil:
+		return st.writeErr.Error()
+	case st.readErr != nil:
+		return st.readErr.Error()
+	default:
+		return closeReasonServerClosed
+	}
+}
+
+// countingConn counts the bytes read from and written to a client of mode,
+// for the metrics and the connection access log record
+type countingConn struct {
+	net.Conn
+	mode    ProtoHackersMode
+	metrics *serverMetrics
+	stats   *connStats
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.metrics.bytesRead.Add(float64(n), string(c.mode))
+	}
+	c.stats.recordRead(n, err)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.metrics.bytesWritten.Add(float64(n), string(c.mode))
+	}
+	c.stats.recordWrite(n, err)
+	return n, err
+}
+
+// logAccess writes the access log record of a connection
+func (s *Server) logAccess(reqID string, mode ProtoHackersMode, remote net.Addr, start time.Time, stats *connStats) {
+	s.accessLogger.Info("connection closed",
+		zap.String("reqID", reqID),
+		zap.String("mode", string(mode)),
+		zap.String("remote", remote.String()),
+		zap.Duration("duration", time.Since(start)),
+		zap.Int64("bytesRead", stats.bytesRead.Load()),
+		zap.Int64("bytesWritten", stats.bytesWritten.Load()),
+		zap.Int64("messagesIn", stats.messagesIn.Load()),
+		zap.Int64("messagesOut", stats.messagesOut.Load()),
+		zap.String("closeReason", stats.reason(s.ctx)),
+	)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/didil/protohackers/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAccessLog(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	accessLogger := zap.New(core)
+
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	s, err := NewMultiServer([]Listener{
+		{Mode: ProtoHackersModeEcho, Port: 35000},
+		{Mode: ProtoHackersModePrimeTime, Port: 35001},
+		{Mode: ProtoHackersModeSpeedDaemon, Port: 35002},
+	}, logger,
+		WithAccessLogger(accessLogger),
+		WithSpeedDaemonDbService(services.NewSpeedDaemonService()),
+		WithIdleTimeout(300*time.Millisecond),
+	)
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	dial := func(port int) *net.TCPConn {
+		conn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+		assert.NoError(t, err)
+		return conn
+	}
+
+	// echo, closed by the client
+	echoConn := dial(35000)
+	_, err = echoConn.Write([]byte("ABCDE"))
+	assert.NoError(t, err)
+	assert.NoError(t, echoConn.CloseWrite())
+	_, err = io.ReadAll(echoConn)
+	assert.NoError(t, err)
+	echoConn.Close()
+
+	// prime, two requests then a malformed one
+	primeConn := dial(35001)
+	defer primeConn.Close()
+	_, err = primeConn.Write([]byte("{\"method\":\"isPrime\",\"number\":3}\n{\"method\":\"isPrime\",\"number\":4}\n{}\n"))
+	assert.NoError(t, err)
+	_, err = io.ReadAll(primeConn)
+	assert.NoError(t, err)
+
+	// speed daemon, a camera sending an illegal message
+	speedConn := dial(35002)
+	defer speedConn.Close()
+	_, err = speedConn.Write([]byte{0x80, 0x00, 0x42, 0x00, 0x64, 0x00, 0x3c, 0x81, 0x00})
+	assert.NoError(t, err)
+	_, err = io.ReadAll(speedConn)
+	assert.NoError(t, err)
+
+	// idle client
+	idleConn := dial(35000)
+	defer idleConn.Close()
+	_, err = io.ReadAll(idleConn)
+	assert.NoError(t, err)
+
+	// open when the server shuts down
+	shutdownConn := dial(35001)
+	defer shutdownConn.Close()
+	_, err = shutdownConn.Write([]byte("{\"method\":\"isPrime\",\"number\":5}\n"))
+	assert.NoError(t, err)
+	assert.True(t, bufio.NewScanner(shutdownConn).Scan())
+
+	time.Sleep(100 * time.Millisecond)
+
+	done <- true
+	<-stopped
+
+	records := logs.FilterMessage("connection closed").All()
+	assert.Len(t, records, 5)
+
+	byRemote := map[string]map[string]interface{}{}
+	for _, r := range records {
+		fields := r.ContextMap()
+		assert.NotEmpty(t, fields["reqID"])
+		assert.Greater(t, fields["duration"], time.Duration(0))
+		byRemote[fields["remote"].(string)] = fields
+	}
+
+	echoRecord := byRemote[echoConn.LocalAddr().String()]
+	assert.Equal(t, "echo", echoRecord["mode"])
+	assert.Equal(t, int64(5), echoRecord["bytesRead"])
+	assert.Equal(t, int64(5), echoRecord["bytesWritten"])
+	assert.Equal(t, "client closed", echoRecord["closeReason"])
+
+	primeRecord := byRemote[primeConn.LocalAddr().String()]
+	assert.Equal(t, "prime", primeRecord["mode"])
+	assert.Equal(t, int64(3), primeRecord["messagesIn"])
+	assert.Equal(t, int64(2), primeRecord["messagesOut"])
+	assert.Equal(t, "malformed request", primeRecord["closeReason"])
+
+	speedRecord := byRemote[speedConn.LocalAddr().String()]
+	assert.Equal(t, "speed-daemon", speedRecord["mode"])
+	assert.Equal(t, int64(9), speedRecord["bytesRead"])
+	assert.Equal(t, int64(2), speedRecord["messagesIn"])
+	assert.Equal(t, int64(1), speedRecord["messagesOut"])
+	assert.Equal(t, "illegal msg: IAmDispatcher from a client already identified as camera", speedRecord["closeReason"])
+
+	assert.Equal(t, "idle timeout", byRemote[idleConn.LocalAddr().String()]["closeReason"])
+	assert.Equal(t, "server shutdown", byRemote[shutdownConn.LocalAddr().String()]["closeReason"])
+}
+
+func TestConnStatsReason(t *testing.T) {
+	serverCtx, cancel := context.WithCancel(context.Background())
+
+	tests := []struct {
+		name        string
+		readErr     error
+		writeErr    error
+		closeReason string
+		expected    string
+	}{
+		{name: "handler reason", readErr: io.EOF, closeReason: "invalid name", expected: "invalid name"},
+		{name: "client closed", readErr: io.EOF, expected: "client closed"},
+		{name: "idle timeout", readErr: os.ErrDeadlineExceeded, expected: "idle timeout"},
+		{name: "write timeout", readErr: io.EOF, writeErr: os.ErrDeadlineExceeded, expected: "write timeout"},
+		{name: "write error", writeErr: errors.New("broken pipe"), expected: "broken pipe"},
+		{name: "read error", readErr: errors.New("connection reset by peer"), expected: "connection reset by peer"},
+		{name: "closed by the handler", expected: "server closed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := newConnStats()
+			stats.recordRead(3, tt.readErr)
+			stats.recordWrite(2, tt.writeErr)
+			stats.setCloseReason(tt.closeReason)
+
+			assert.Equal(t, tt.expected, stats.reason(serverCtx))
+		})
+	}
+
+	cancel()
+	assert.Equal(t, "server shutdown", newConnStats().reason(serverCtx))
+
+	// handlers running outside of HandleTCPConn have no stats
+	var stats *connStats
+	stats.messageIn()
+	stats.messageOut()
+	stats.setCloseReason("invalid name")
+}
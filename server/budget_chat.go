@@ -6,23 +6,36 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/didil/protohackers/services"
 	"go.uber.org/zap"
 )
 
-var chatMessageLimit = 1000
+const ProtoHackersModeBudgetChat = "budget_chat"
+
+func init() {
+	RegisterMode(ProtoHackersModeBudgetChat, TransportTCP, func(s *Server) (Handler, error) {
+		return HandlerFunc(s.HandleBudgetChat), nil
+	})
+}
+
+const DefaultChatMessageLimit = 1000
 
 func (s *Server) HandleBudgetChat(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 	reqID, _ := ctx.Value(reqIDContextKey).(string)
+	stats := connStatsFromContext(ctx)
 
 	welcomeMsg := "Welcome to budgetchat! What shall I call you?"
 
 	_, err := conn.Write([]byte(welcomeMsg + "\n"))
 	if err != nil {
-		s.logger.Error("HandleBudgetChat write error", zap.Error(err))
+		s.handlerError(ProtoHackersModeBudgetChat, "HandleBudgetChat write error", zap.Error(err))
 		return
 	}
+	stats.messageOut()
 
 	s.logger.Info("Welcome given", zap.String("reqID", reqID))
 
@@ -32,68 +45,219 @@ func (s *Server) HandleBudgetChat(ctx context.Context, conn net.Conn) {
 	if !ok {
 		err := sc.Err()
 		if err != nil {
-			s.logger.Error("HandleBudgetChat name scan error", zap.Error(err))
+			s.handlerError(ProtoHackersModeBudgetChat, "HandleBudgetChat name scan error", zap.Error(err))
 			return
 		}
 	}
 
+	stats.messageIn()
+
 	name := string(sc.Bytes())
 	if !s.chatSvc.IsValidName(name) {
-		s.logger.Error("HandleBudgetChat invalid chat name", zap.String("name", name))
+		stats.setCloseReason("invalid name")
+		s.handlerError(ProtoHackersModeBudgetChat, "HandleBudgetChat invalid chat name", zap.String("name", name))
+		s.rejectChatName(conn, stats, "names must be 1 to 16 letters or digits")
 		return
 	}
 
 	s.logger.Info("New user name received", zap.String("name", name))
 
-	// tell user about current room users
-	userNames := s.chatSvc.ListCurrentUsersNames()
-	currentUsersMsg := "* The room contains: " + strings.Join(userNames, ", ")
+	// add user to room, checking the name is free at the same time
+	userId, userChan, snapshot, err := s.chatSvc.AddUser(name)
+	if err != nil {
+		stats.setCloseReason("rejected name")
+		s.logger.Info("Chat name rejected", zap.String("name", name), zap.Error(err))
+		s.rejectChatName(conn, stats, err.Error())
+		return
+	}
+	s.logger.Info("New user added received", zap.String("name", name), zap.Int("userId", userId))
 
-	_, err = conn.Write([]byte(currentUsersMsg + "\n"))
+	// tell user about the other room users
+	room := services.DefaultChatRoom
+	err = s.writeChatRoomSnapshot(conn, stats, snapshot)
 	if err != nil {
-		s.logger.Error("HandleBudgetChat room contains write error", zap.Error(err))
+		s.handlerError(ProtoHackersModeBudgetChat, "HandleBudgetChat room contains write error", zap.Error(err))
+		// nobody was told the user entered
+		s.chatSvc.RemoveUser(userId)
 		return
 	}
 
-	// add user to room
-	userId, userChan := s.chatSvc.AddUser(name)
-	s.logger.Info("New user added received", zap.String("name", name), zap.Int("userId", userId))
+	// leaving is set once the user is being removed, disconnected if the chat service dropped it as a slow consumer
+	leaving := &atomic.Bool{}
+	disconnected := &atomic.Bool{}
+	// writerLock is held by the messages writer, room changes take it to pause the writer
+	// until the new room listing and history are written
+	writerLock := &sync.Mutex{}
 
 	go func() {
 		for msg := range userChan {
-			_, err = conn.Write([]byte(msg + "\n"))
+			writerLock.Lock()
+			err := s.writeChatLine(conn, stats, msg)
+			writerLock.Unlock()
 			if err != nil {
-				s.logger.Error("HandleBudgetChat write message error", zap.Error(err), zap.Int("userId", userId))
+				s.handlerError(ProtoHackersModeBudgetChat, "HandleBudgetChat write message error", zap.Error(err), zap.Int("userId", userId))
 				s.removeChatUserAndAnnounce(userId, name)
 				return
 			}
 		}
+
+		if !leaving.Load() {
+			// the channel was closed by the slow consumer policy, stop reading too
+			s.logger.Info("Slow chat user disconnected", zap.String("name", name), zap.Int("userId", userId))
+			disconnected.Store(true)
+			stats.setCloseReason("slow consumer")
+			conn.Close()
+		}
 	}()
 
 	// announce user joined to current users
-	s.chatSvc.Broadcast(userId, fmt.Sprintf("* %s has entered the room", name))
+	s.chatSvc.Broadcast(room, userId, fmt.Sprintf("* %s has entered the room", name))
+
+	for ctx.Err() == nil && sc.Scan() {
+		stats.messageIn()
 
-	for sc.Scan() {
 		data := sc.Bytes()
-		if len(data) > chatMessageLimit {
-			data = data[:chatMessageLimit]
+		if len(data) > s.chatMessageLimit {
+			data = data[:s.chatMessageLimit]
+		}
+		msg := string(data)
+
+		if cmd, arg, ok := parseChatCommand(msg); ok {
+			room, err = s.handleChatCommand(conn, stats, writerLock, userId, name, room, cmd, arg)
+			if err != nil {
+				s.handlerError(ProtoHackersModeBudgetChat, "HandleBudgetChat command error", zap.Error(err), zap.String("command", cmd))
+				break
+			}
+			continue
 		}
-		s.chatSvc.Broadcast(userId, fmt.Sprintf("[%s] %s", name, string(data)))
+
+		s.chatSvc.Post(room, userId, fmt.Sprintf("[%s] %s", name, msg))
 	}
 
 	err = sc.Err()
-	if err != nil {
-		s.logger.Error("HandleBudgetChat scan error", zap.Error(err))
-		s.removeChatUserAndAnnounce(userId, name)
-		return
+	if err != nil && ctx.Err() == nil && !disconnected.Load() {
+		s.handlerError(ProtoHackersModeBudgetChat, "HandleBudgetChat scan error", zap.Error(err))
 	}
 
+	leaving.Store(true)
 	s.removeChatUserAndAnnounce(userId, name)
 }
 
+const (
+	chatCommandJoin  = "/join"
+	chatCommandLeave = "/leave"
+	chatCommandRooms = "/rooms"
+	chatCommandMsg   = "/msg"
+)
+
+// parseChatCommand splits a command line into the command and its argument,
+// lines that are not known commands are plain chat messages
+func parseChatCommand(msg string) (string, string, bool) {
+	cmd, arg, _ := strings.Cut(msg, " ")
+	switch cmd {
+	case chatCommandJoin, chatCommandLeave, chatCommandRooms, chatCommandMsg:
+		return cmd, strings.TrimSpace(arg), true
+	default:
+		return "", "", false
+	}
+}
+
+// handleChatCommand runs the command for the user in room and returns the room the user is in afterwards
+func (s *Server) handleChatCommand(conn net.Conn, stats *connStats, writerLock *sync.Mutex, userId int, name string, room string, cmd string, arg string) (string, error) {
+	switch cmd {
+	case chatCommandJoin:
+		if !s.chatSvc.IsValidRoomName(arg) {
+			return room, s.writeChatLine(conn, stats, fmt.Sprintf("* Invalid room name: %s, room names must be 1 to 32 letters, digits, - or _", arg))
+		}
+		return s.changeChatRoom(conn, stats, writerLock, userId, name, room, arg)
+	case chatCommandLeave:
+		return s.changeChatRoom(conn, stats, writerLock, userId, name, room, services.DefaultChatRoom)
+	case chatCommandRooms:
+		return room, s.writeChatLine(conn, stats, "* Rooms: "+strings.Join(s.chatSvc.ListRooms(), ", "))
+	case chatCommandMsg:
+		to, text, _ := strings.Cut(arg, " ")
+		if to == "" || text == "" {
+			return room, s.writeChatLine(conn, stats, "* Usage: /msg <name> <text>")
+		}
+		if !s.chatSvc.SendTo(to, fmt.Sprintf("[%s -> %s] %s", name, to, text)) {
+			return room, s.writeChatLine(conn, stats, fmt.Sprintf("* Unknown user: %s", to))
+		}
+		return room, nil
+	default:
+		return room, fmt.Errorf("unknown command %s", cmd)
+	}
+}
+
+// changeChatRoom moves the user from room to newRoom and announces it in both rooms.
+// The messages writer is paused from the join until the new room listing and history are written,
+// so that the messages posted in newRoom meanwhile come after them
+func (s *Server) changeChatRoom(conn net.Conn, stats *connStats, writerLock *sync.Mutex, userId int, name string, room string, newRoom string) (string, error) {
+	if newRoom == room {
+		return room, s.writeChatLine(conn, stats, fmt.Sprintf("* You are already in %s", room))
+	}
+
+	writerLock.Lock()
+	defer writerLock.Unlock()
+
+	_, snapshot, err := s.chatSvc.JoinRoom(userId, newRoom)
+	if err != nil {
+		return room, err
+	}
+
+	// announce the move before writing to the user, so that the left message sent to newRoom
+	// if the user is removed on a write error matches an entered one
+	s.chatSvc.Broadcast(room, userId, fmt.Sprintf("* %s has left the room", name))
+	s.chatSvc.Broadcast(newRoom, userId, fmt.Sprintf("* %s has entered the room", name))
+
+	return newRoom, s.writeChatRoomSnapshot(conn, stats, snapshot)
+}
+
+// writeChatRoomSnapshot tells the user entering a room who is in it, then sends its recent messages
+// with the time they were posted
+func (s *Server) writeChatRoomSnapshot(conn net.Conn, stats *connStats, snapshot services.ChatRoomSnapshot) error {
+	err := s.writeChatLine(conn, stats, "* The room contains: "+strings.Join(snapshot.Users, ", "))
+	if err != nil {
+		return err
+	}
+
+	for _, m := range snapshot.History {
+		err := s.writeChatLine(conn, stats, fmt.Sprintf("* %s %s", m.Time.UTC().Format(chatHistoryTimeLayout), m.Msg))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const chatHistoryTimeLayout = "15:04:05"
+
+// writeChatLine writes msg as a single line, so that it doesn't interleave with the lines written by other goroutines
+func (s *Server) writeChatLine(conn net.Conn, stats *connStats, msg string) error {
+	_, err := conn.Write([]byte(msg + "\n"))
+	if err != nil {
+		return err
+	}
+	stats.messageOut()
+
+	return nil
+}
+
+// rejectChatName tells the user why its name was refused before the connection is closed
+func (s *Server) rejectChatName(conn net.Conn, stats *connStats, reason string) {
+	err := s.writeChatLine(conn, stats, "* Name rejected: "+reason)
+	if err != nil {
+		s.handlerError(ProtoHackersModeBudgetChat, "HandleBudgetChat name rejection write error", zap.Error(err))
+	}
+}
+
 func (s *Server) removeChatUserAndAnnounce(userId int, name string) {
-	s.chatSvc.RemoveUser(userId)
+	room, ok := s.chatSvc.RemoveUser(userId)
+	if !ok {
+		// already removed and announced
+		return
+	}
 
 	// announce user left to current users
-	s.chatSvc.Broadcast(userId, fmt.Sprintf("* %s has left the room", name))
+	s.chatSvc.Broadcast(room, userId, fmt.Sprintf("* %s has left the room", name))
 }
@@ -2,11 +2,14 @@ package server
 
 import (
 	"bufio"
+	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/didil/protohackers/mocks"
+	"github.com/didil/protohackers/services"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
@@ -28,13 +31,18 @@ func TestHandleBudgetChat(t *testing.T) {
 	userChan := make(chan string, 256)
 
 	chatSvc.EXPECT().IsValidName(myUserName).Return(true)
-	chatSvc.EXPECT().ListCurrentUsersNames().Return([]string{"danny", "eva"})
-	chatSvc.EXPECT().AddUser(myUserName).Return(userId, userChan)
-	chatSvc.EXPECT().Broadcast(userId, "* peter has entered the room").Return()
-	chatSvc.EXPECT().Broadcast(userId, "[peter] Hello folks").Return()
-	chatSvc.EXPECT().Broadcast(userId, "[peter] Bye folks").Return()
-	chatSvc.EXPECT().RemoveUser(userId).Return()
-	chatSvc.EXPECT().Broadcast(userId, "* peter has left the room").Return()
+	chatSvc.EXPECT().AddUser(myUserName).Return(userId, userChan, services.ChatRoomSnapshot{
+		Users: []string{"danny", "eva"},
+		History: []services.ChatMessage{
+			{Time: time.Date(2023, 1, 2, 10, 30, 0, 0, time.UTC), Msg: "[danny] hi eva"},
+			{Time: time.Date(2023, 1, 2, 10, 31, 5, 0, time.UTC), Msg: "[eva] hi danny"},
+		},
+	}, nil)
+	chatSvc.EXPECT().Broadcast(services.DefaultChatRoom, userId, "* peter has entered the room").Return()
+	chatSvc.EXPECT().Post(services.DefaultChatRoom, userId, "[peter] Hello folks").Return()
+	chatSvc.EXPECT().Post(services.DefaultChatRoom, userId, "[peter] Bye folks").Return()
+	chatSvc.EXPECT().RemoveUser(userId).Return(services.DefaultChatRoom, true)
+	chatSvc.EXPECT().Broadcast(services.DefaultChatRoom, userId, "* peter has left the room").Return()
 
 	s, err := NewServer(mode, port, logger, WithChatService(chatSvc))
 	assert.NoError(t, err)
@@ -73,6 +81,11 @@ func TestHandleBudgetChat(t *testing.T) {
 	roomContainsMsg := string(sc.Bytes())
 	assert.Equal(t, "* The room contains: danny, eva", roomContainsMsg)
 
+	assert.True(t, sc.Scan())
+	assert.Equal(t, "* 10:30:00 [danny] hi eva", sc.Text())
+	assert.True(t, sc.Scan())
+	assert.Equal(t, "* 10:31:05 [eva] hi danny", sc.Text())
+
 	_, err = conn.Write([]byte("Hello folks" + "\n"))
 	assert.NoError(t, err)
 
@@ -87,3 +100,461 @@ func TestHandleBudgetChat(t *testing.T) {
 	done <- true
 	time.Sleep(100 * time.Millisecond)
 }
+
+func TestHandleBudgetChatRooms(t *testing.T) {
+	mode := ProtoHackersModeBudgetChat
+	port := 35000
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	chatSvc := services.NewChatService(logger)
+
+	s, err := NewServer(mode, port, logger, WithChatService(chatSvc))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	join := func(name string) (net.Conn, *bufio.Scanner) {
+		conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+		assert.NoError(t, err)
+
+		sc := bufio.NewScanner(conn)
+		assert.True(t, sc.Scan())
+		_, err = conn.Write([]byte(name + "\n"))
+		assert.NoError(t, err)
+		assert.True(t, sc.Scan())
+
+		return conn, sc
+	}
+	send := func(conn net.Conn, msg string) {
+		_, err := conn.Write([]byte(msg + "\n"))
+		assert.NoError(t, err)
+	}
+	expect := func(sc *bufio.Scanner, msg string) {
+		assert.True(t, sc.Scan())
+		assert.Equal(t, msg, sc.Text())
+	}
+
+	aliceConn, aliceSc := join("alice")
+	defer aliceConn.Close()
+	bobConn, bobSc := join("bob")
+	defer bobConn.Close()
+	expect(aliceSc, "* bob has entered the room")
+
+	send(bobConn, "/join games")
+	expect(bobSc, "* The room contains: ")
+	expect(aliceSc, "* bob has left the room")
+
+	send(bobConn, "/rooms")
+	expect(bobSc, "* Rooms: games, lobby")
+
+	send(bobConn, "/join games")
+	expect(bobSc, "* You are already in games")
+
+	send(bobConn, "/join bad room!")
+	expect(bobSc, "* Invalid room name: bad room!, room names must be 1 to 32 letters, digits, - or _")
+
+	// alice's messages stay in the default room
+	send(aliceConn, "anybody here?")
+	send(aliceConn, "/join games")
+	expect(aliceSc, "* The room contains: bob")
+	expect(bobSc, "* alice has entered the room")
+
+	send(bobConn, "hi alice")
+	expect(aliceSc, "[bob] hi alice")
+
+	send(aliceConn, "/leave")
+	expect(aliceSc, "* The room contains: ")
+	expect(bobSc, "* alice has left the room")
+
+	send(aliceConn, "/msg bob psst")
+	expect(bobSc, "[alice -> bob] psst")
+
+	send(bobConn, "/msg carol hello")
+	expect(bobSc, "* Unknown user: carol")
+
+	send(bobConn, "/msg alice")
+	expect(bobSc, "* Usage: /msg <name> <text>")
+
+	// unknown commands are plain messages
+	send(aliceConn, "/me waves")
+	send(aliceConn, "/join games")
+	expect(aliceSc, "* The room contains: bob")
+
+	err = bobConn.Close()
+	assert.NoError(t, err)
+	expect(aliceSc, "* bob has left the room")
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestChangeChatRoomWriteError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	chatSvc := mocks.NewMockChatService(ctrl)
+	s, err := NewServer(ProtoHackersModeBudgetChat, 35000, logger, WithChatService(chatSvc))
+	assert.NoError(t, err)
+
+	userId := 101
+	gomock.InOrder(
+		chatSvc.EXPECT().JoinRoom(userId, "games").Return(services.DefaultChatRoom, services.ChatRoomSnapshot{Users: []string{"eva"}}, nil),
+		chatSvc.EXPECT().Broadcast(services.DefaultChatRoom, userId, "* peter has left the room").Return(),
+		// games is told the user entered even though the room listing can't be written,
+		// the left message sent when the user is removed matches it
+		chatSvc.EXPECT().Broadcast("games", userId, "* peter has entered the room").Return(),
+	)
+
+	conn, peer := net.Pipe()
+	peer.Close()
+	defer conn.Close()
+
+	room, err := s.changeChatRoom(conn, nil, &sync.Mutex{}, userId, "peter", services.DefaultChatRoom, "games")
+	assert.Error(t, err)
+	assert.Equal(t, "games", room)
+}
+
+func TestHandleBudgetChatNameRejected(t *testing.T) {
+	mode := ProtoHackersModeBudgetChat
+	port := 35000
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	chatSvc := services.NewChatService(logger, services.WithChatReservedNames("admin"))
+
+	s, err := NewServer(mode, port, logger, WithChatService(chatSvc))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	aliceConn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.NoError(t, err)
+	defer aliceConn.Close()
+
+	aliceSc := bufio.NewScanner(aliceConn)
+	assert.True(t, aliceSc.Scan())
+	_, err = aliceConn.Write([]byte("alice\n"))
+	assert.NoError(t, err)
+	assert.True(t, aliceSc.Scan())
+	assert.Equal(t, "* The room contains: ", aliceSc.Text())
+
+	testCases := []struct {
+		name    string
+		message string
+	}{
+		{name: "Alice", message: "* Name rejected: name already taken"},
+		{name: "Admin", message: "* Name rejected: name reserved"},
+		{name: "bad name", message: "* Name rejected: names must be 1 to 16 letters or digits"},
+	}
+
+	for _, tc := range testCases {
+		conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+		assert.NoError(t, err)
+
+		sc := bufio.NewScanner(conn)
+		assert.True(t, sc.Scan())
+		_, err = conn.Write([]byte(tc.name + "\n"))
+		assert.NoError(t, err)
+
+		assert.True(t, sc.Scan())
+		assert.Equal(t, tc.message, sc.Text())
+
+		// the connection is closed after the rejection
+		assert.False(t, sc.Scan())
+		conn.Close()
+	}
+
+	assert.Equal(t, []string{"alice"}, chatSvc.ListCurrentUsersNames())
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestHandleBudgetChatSlowConsumerDisconnected(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mode := ProtoHackersModeBudgetChat
+	port := 35000
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	chatSvc := mocks.NewMockChatService(ctrl)
+
+	userId := 101
+	userChan := make(chan string, 256)
+
+	chatSvc.EXPECT().IsValidName("peter").Return(true)
+	chatSvc.EXPECT().AddUser("peter").Return(userId, userChan, services.ChatRoomSnapshot{}, nil)
+	chatSvc.EXPECT().Broadcast(services.DefaultChatRoom, userId, "* peter has entered the room").Return()
+	chatSvc.EXPECT().RemoveUser(userId).Return(services.DefaultChatRoom, true)
+	chatSvc.EXPECT().Broadcast(services.DefaultChatRoom, userId, "* peter has left the room").Return()
+
+	s, err := NewServer(mode, port, logger, WithChatService(chatSvc))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	sc := bufio.NewScanner(conn)
+	assert.True(t, sc.Scan())
+	_, err = conn.Write([]byte("peter\n"))
+	assert.NoError(t, err)
+	assert.True(t, sc.Scan())
+	assert.Equal(t, "* The room contains: ", sc.Text())
+
+	// the chat service gave up on the user
+	userChan <- "* danny has entered the room"
+	close(userChan)
+
+	assert.True(t, sc.Scan())
+	assert.Equal(t, "* danny has entered the room", sc.Text())
+
+	// the server closes the connection
+	assert.False(t, sc.Scan())
+	assert.NoError(t, sc.Err())
+
+	time.Sleep(50 * time.Millisecond)
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestHandleBudgetChatHistory(t *testing.T) {
+	mode := ProtoHackersModeBudgetChat
+	port := 35000
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	chatSvc := services.NewChatService(logger, services.WithChatHistorySize(2))
+
+	s, err := NewServer(mode, port, logger, WithChatService(chatSvc))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	join := func(name string) (net.Conn, *bufio.Scanner) {
+		conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+		assert.NoError(t, err)
+
+		sc := bufio.NewScanner(conn)
+		assert.True(t, sc.Scan())
+		_, err = conn.Write([]byte(name + "\n"))
+		assert.NoError(t, err)
+
+		return conn, sc
+	}
+
+	aliceConn, aliceSc := join("alice")
+	defer aliceConn.Close()
+	assert.True(t, aliceSc.Scan())
+	assert.Equal(t, "* The room contains: ", aliceSc.Text())
+
+	for _, msg := range []string{"one", "two", "three"} {
+		_, err = aliceConn.Write([]byte(msg + "\n"))
+		assert.NoError(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	bobConn, bobSc := join("bob")
+	defer bobConn.Close()
+	assert.True(t, bobSc.Scan())
+	assert.Equal(t, "* The room contains: alice", bobSc.Text())
+
+	// the last 2 messages are replayed with their time
+	assert.True(t, bobSc.Scan())
+	assert.Regexp(t, `^\* \d\d:\d\d:\d\d \[alice\] two$`, bobSc.Text())
+	assert.True(t, bobSc.Scan())
+	assert.Regexp(t, `^\* \d\d:\d\d:\d\d \[alice\] three$`, bobSc.Text())
+
+	_, err = aliceConn.Write([]byte("hi bob\n"))
+	assert.NoError(t, err)
+	assert.True(t, bobSc.Scan())
+	assert.Equal(t, "[alice] hi bob", bobSc.Text())
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestHandleBudgetChatHistoryPostedWhileJoining(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mode := ProtoHackersModeBudgetChat
+	port := 35000
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	chatSvc := mocks.NewMockChatService(ctrl)
+
+	userId := 101
+	userChan := make(chan string, 256)
+
+	chatSvc.EXPECT().IsValidName("peter").Return(true)
+	chatSvc.EXPECT().AddUser("peter").DoAndReturn(func(name string) (int, chan string, services.ChatRoomSnapshot, error) {
+		snapshot := services.ChatRoomSnapshot{
+			Users:   []string{"danny"},
+			History: []services.ChatMessage{{Time: time.Date(2023, 1, 2, 10, 30, 0, 0, time.UTC), Msg: "[danny] before"}},
+		}
+		// posted once peter joined, before the history is replayed
+		userChan <- "[danny] after"
+		return userId, userChan, snapshot, nil
+	})
+	chatSvc.EXPECT().Broadcast(services.DefaultChatRoom, userId, "* peter has entered the room").Return()
+	chatSvc.EXPECT().RemoveUser(userId).Return(services.DefaultChatRoom, true)
+	chatSvc.EXPECT().Broadcast(services.DefaultChatRoom, userId, "* peter has left the room").Return()
+
+	s, err := NewServer(mode, port, logger, WithChatService(chatSvc))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.NoError(t, err)
+
+	sc := bufio.NewScanner(conn)
+	assert.True(t, sc.Scan())
+	_, err = conn.Write([]byte("peter\n"))
+	assert.NoError(t, err)
+
+	lines := []string{}
+	err = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	assert.NoError(t, err)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+
+	assert.Equal(t, []string{
+		"* The room contains: danny",
+		"* 10:30:00 [danny] before",
+		"[danny] after",
+	}, lines)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestHandleBudgetChatHistoryPostedWhileChangingRoom(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mode := ProtoHackersModeBudgetChat
+	port := 35000
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	chatSvc := mocks.NewMockChatService(ctrl)
+
+	userId := 101
+	userChan := make(chan string, 256)
+
+	chatSvc.EXPECT().IsValidName("peter").Return(true)
+	chatSvc.EXPECT().IsValidRoomName("games").Return(true)
+	chatSvc.EXPECT().AddUser("peter").Return(userId, userChan, services.ChatRoomSnapshot{}, nil)
+	chatSvc.EXPECT().Broadcast(services.DefaultChatRoom, userId, "* peter has entered the room").Return()
+	chatSvc.EXPECT().JoinRoom(userId, "games").DoAndReturn(func(id int, room string) (string, services.ChatRoomSnapshot, error) {
+		snapshot := services.ChatRoomSnapshot{
+			Users:   []string{"eva"},
+			History: []services.ChatMessage{{Time: time.Date(2023, 1, 2, 10, 30, 0, 0, time.UTC), Msg: "[eva] before"}},
+		}
+		// posted once peter joined, the writer has time to pick it up before the history is replayed
+		userChan <- "[eva] after"
+		time.Sleep(50 * time.Millisecond)
+		return services.DefaultChatRoom, snapshot, nil
+	})
+	chatSvc.EXPECT().Broadcast(services.DefaultChatRoom, userId, "* peter has left the room").Return()
+	chatSvc.EXPECT().Broadcast("games", userId, "* peter has entered the room").Return()
+	chatSvc.EXPECT().RemoveUser(userId).Return("games", true)
+	chatSvc.EXPECT().Broadcast("games", userId, "* peter has left the room").Return()
+
+	s, err := NewServer(mode, port, logger, WithChatService(chatSvc))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.NoError(t, err)
+
+	sc := bufio.NewScanner(conn)
+	assert.True(t, sc.Scan())
+	_, err = conn.Write([]byte("peter\n"))
+	assert.NoError(t, err)
+	assert.True(t, sc.Scan())
+	assert.Equal(t, "* The room contains: ", sc.Text())
+
+	_, err = conn.Write([]byte("/join games\n"))
+	assert.NoError(t, err)
+
+	lines := []string{}
+	err = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	assert.NoError(t, err)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+
+	assert.Equal(t, []string{
+		"* The room contains: eva",
+		"* 10:30:00 [eva] before",
+		"[eva] after",
+	}, lines)
+
+	err = conn.Close()
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// deadlineConn refreshes the read and write deadlines before every read and write,
+// and stops reading once its context is cancelled
+type deadlineConn struct {
+	net.Conn
+	ctx context.Context
+	// idleTimeout is the longest wait for data from the peer, 0 means no limit
+	idleTimeout time.Duration
+	// writeTimeout is the longest wait for a write to complete, 0 means no limit
+	writeTimeout time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var deadline time.Time
+	if c.idleTimeout > 0 {
+		deadline = time.Now().Add(c.idleTimeout)
+	}
+	err := c.Conn.SetReadDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+
+	// the cancellation may have set a past deadline that was just replaced
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Read(p)
+	if err != nil && c.ctx.Err() != nil {
+		return n, c.ctx.Err()
+	}
+
+	return n, err
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	var deadline time.Time
+	if c.writeTimeout > 0 {
+		deadline = time.Now().Add(c.writeTimeout)
+	}
+	err := c.Conn.SetWriteDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(p)
+}
+
+// wrapConn applies the server timeouts to conn, and ends its reads when ctx is cancelled
+func (s *Server) wrapConn(ctx context.Context, conn net.Conn) net.Conn {
+	return &deadlineConn{
+		Conn:         conn,
+		ctx:          ctx,
+		idleTimeout:  s.idleTimeout,
+		writeTimeout: s.writeTimeout,
+	}
+}
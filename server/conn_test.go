@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	s, err := NewServer(ProtoHackersModeEcho, 35000, logger, WithIdleTimeout(200*time.Millisecond))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "localhost:35000")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// activity keeps the connection open past the idle timeout
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write([]byte("a"))
+		assert.NoError(t, err)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the idle connection is closed by the server
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "aaa", string(resp))
+
+	close(done)
+	<-stopped
+}
+
+func TestDeadlineConnCancel(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+
+	s := &Server{}
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := s.wrapConn(ctx, srv)
+
+	readErr := make(chan error)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		readErr <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	// the watcher from HandleTCPConn unblocks pending reads
+	srv.SetReadDeadline(time.Now())
+
+	select {
+	case err := <-readErr:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("read not interrupted")
+	}
+
+	_, err := conn.Read(make([]byte, 10))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDeadlineConnWriteTimeout(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+
+	s := &Server{writeTimeout: 100 * time.Millisecond}
+	conn := s.wrapConn(context.Background(), srv)
+
+	// nobody reads from the client side so the write blocks
+	_, err := conn.Write([]byte("hello"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
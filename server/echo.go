@@ -8,41 +8,34 @@ import (
 	"go.uber.org/zap"
 )
 
+const ProtoHackersModeEcho = "echo"
+
+func init() {
+	RegisterMode(ProtoHackersModeEcho, TransportTCP, func(s *Server) (Handler, error) {
+		return HandlerFunc(s.HandleEcho), nil
+	})
+}
+
 func (s *Server) HandleEcho(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
 	bufSize := 4096
 	data := make([]byte, bufSize)
 
-	var totalRead int
-	var totalWritten int
-
-	for {
+	for ctx.Err() == nil {
 		n, err := conn.Read(data)
-		if err == io.EOF {
+		if err == io.EOF || ctx.Err() != nil {
 			break
 		}
 		if err != nil {
-			s.logger.Error("HandleEcho read error", zap.Error(err))
+			s.handlerError(ProtoHackersModeEcho, "HandleEcho read error", zap.Error(err))
 			break
 		}
 
-		totalRead += n
-
-		p, err := conn.Write(data[:n])
+		_, err = conn.Write(data[:n])
 		if err != nil {
-			s.logger.Error("HandleEcho write error", zap.Error(err))
+			s.handlerError(ProtoHackersModeEcho, "HandleEcho write error", zap.Error(err))
 			break
 		}
-
-		totalWritten += p
 	}
-
-	reqID, _ := ctx.Value(reqIDContextKey).(string)
-	s.logger.Info("echo results",
-		zap.String("reqID", reqID),
-		zap.String("remote", conn.RemoteAddr().String()),
-		zap.Int("totalRead", totalRead),
-		zap.Int("totalWritten", totalWritten),
-	)
 }
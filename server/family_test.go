@@ -0,0 +1,128 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/didil/protohackers/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestAddressFamilies(t *testing.T) {
+	tests := []struct {
+		name          string
+		bindAddress   string
+		addressFamily AddressFamily
+		reachableIPs  []string
+		// ips the listeners must not serve
+		unreachableIPs []string
+	}{
+		{
+			name:           "ipv4 loopback",
+			bindAddress:    "127.0.0.1",
+			addressFamily:  AddressFamilyIPv4,
+			reachableIPs:   []string{"127.0.0.1"},
+			unreachableIPs: []string{"::1"},
+		},
+		{
+			name:           "ipv6 loopback",
+			bindAddress:    "::1",
+			addressFamily:  AddressFamilyIPv6,
+			reachableIPs:   []string{"::1"},
+			unreachableIPs: []string{"127.0.0.1"},
+		},
+		{
+			name:          "dual stack",
+			bindAddress:   "",
+			addressFamily: AddressFamilyDualStack,
+			reachableIPs:  []string{"127.0.0.1", "::1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, err := zap.NewDevelopment()
+			assert.NoError(t, err)
+
+			s, err := NewMultiServer([]Listener{
+				{Mode: ProtoHackersModeEcho, Port: 35000},
+				{Mode: ProtoHackersModeUnusualDatabase, Port: 35000},
+			}, logger,
+				WithUnusualDbService(services.NewUnusualDbService()),
+				WithBindAddress(tt.bindAddress),
+				WithAddressFamily(tt.addressFamily),
+			)
+			assert.NoError(t, err)
+
+			done := make(chan bool, 1)
+			stopped := make(chan bool)
+
+			go func() {
+				err := s.Start(done)
+				assert.NoError(t, err)
+				close(stopped)
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+
+			for _, ip := range tt.reachableIPs {
+				// echo
+				tcpConn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP(ip), Port: 35000})
+				if assert.NoError(t, err, ip) {
+					_, err = tcpConn.Write([]byte("ABC"))
+					assert.NoError(t, err)
+					assert.NoError(t, tcpConn.CloseWrite())
+
+					readData, err := io.ReadAll(tcpConn)
+					assert.NoError(t, err)
+					assert.Equal(t, "ABC", string(readData), ip)
+					tcpConn.Close()
+				}
+
+				// unusual database
+				udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(ip), Port: 35000})
+				if assert.NoError(t, err, ip) {
+					_, err = udpConn.Write([]byte("version"))
+					assert.NoError(t, err)
+
+					udpConn.SetReadDeadline(time.Now().Add(time.Second))
+					outputData := make([]byte, DefaultUDMaxContentSize)
+					n, err := udpConn.Read(outputData)
+					assert.NoError(t, err, ip)
+					assert.Equal(t, "version=Ken's Key-Value Store 1.0", string(outputData[:n]))
+					udpConn.Close()
+				}
+			}
+
+			for _, ip := range tt.unreachableIPs {
+				_, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP(ip), Port: 35000})
+				assert.Error(t, err, ip)
+			}
+
+			done <- true
+			<-stopped
+		})
+	}
+}
+
+func TestValidateBindAddress(t *testing.T) {
+	assert.NoError(t, validateBindAddress("", AddressFamilyIPv4))
+	assert.NoError(t, validateBindAddress("0.0.0.0", AddressFamilyIPv4))
+	assert.NoError(t, validateBindAddress("::", AddressFamilyIPv6))
+	assert.NoError(t, validateBindAddress("::1", AddressFamilyDualStack))
+	assert.NoError(t, validateBindAddress("127.0.0.1", AddressFamilyDualStack))
+
+	assert.EqualError(t, validateBindAddress("", "ipv5"), "invalid address family ipv5")
+	assert.EqualError(t, validateBindAddress("localhost", AddressFamilyIPv4), "invalid bind address localhost")
+	assert.EqualError(t, validateBindAddress("::1", AddressFamilyIPv4), "bind address ::1 is not an ipv4 address")
+	assert.EqualError(t, validateBindAddress("127.0.0.1", AddressFamilyIPv6), "bind address 127.0.0.1 is not an ipv6 address")
+
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	_, err = NewServer(ProtoHackersModeEcho, 35000, logger, WithBindAddress("::1"))
+	assert.EqualError(t, err, "bind address ::1 is not an ipv4 address")
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	errShuttingDown       = errors.New("server shutting down")
+	errTooManyConns       = errors.New("too many connections")
+	errTooManyConnsFromIP = errors.New("too many connections from remote ip")
+)
+
+// remoteIP returns the ip part of addr, or the whole address if it has no port
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UDPAddr:
+		return a.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// tokenBucket allows burst events at once then rate events per second
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// full returns true if the bucket is back to its burst size, it can then be forgotten
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// udpPruneInterval is how often full buckets are removed from the rate limiter
+var udpPruneInterval = time.Minute
+
+// udpRateLimiter keeps a token bucket per remote ip
+type udpRateLimiter struct {
+	rate      float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	lock      *sync.Mutex
+}
+
+func newUDPRateLimiter(rate float64, burst int) *udpRateLimiter {
+	return &udpRateLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   map[string]*tokenBucket{},
+		lastPrune: time.Now(),
+		lock:      &sync.Mutex{},
+	}
+}
+
+func (l *udpRateLimiter) allow(ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(l.lastPrune) >= udpPruneInterval {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = newTokenBucket(l.rate, l.burst, now)
+		l.buckets[ip] = b
+	}
+
+	return b.allow(now)
+}
+
+// rateLimitedUDPConn drops the datagrams of remote ips going over the rate limit
+type rateLimitedUDPConn struct {
+	*net.UDPConn
+	limiter *udpRateLimiter
+	// onDrop is called with the sender of every dropped datagram
+	onDrop func(addr net.Addr)
+}
+
+func (c *rateLimitedUDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.UDPConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		if c.limiter.allow(remoteIP(addr)) {
+			return n, addr, nil
+		}
+
+		c.onDrop(addr)
+	}
+}
+
+const (
+	udpDropRateLimit   = "rate_limit"
+	udpDropWorkersBusy = "workers_busy"
+)
+
+type udpDropKey struct {
+	mode   ProtoHackersMode
+	ip     string
+	reason string
+}
+
+type udpDropEntry struct {
+	lastLog time.Time
+	// unlogged are the drops since the last log
+	unlogged int
+}
+
+// udpDropLog logs the dropped datagrams at most once per mode, remote ip and reason every udpPruneInterval,
+// with the number of drops since the previous log, so that a flooding client doesn't flood the log too
+type udpDropLog struct {
+	logger    *zap.Logger
+	entries   map[udpDropKey]*udpDropEntry
+	lastPrune time.Time
+	lock      *sync.Mutex
+}
+
+func newUDPDropLog(logger *zap.Logger) *udpDropLog {
+	return &udpDropLog{
+		logger:    logger,
+		entries:   map[udpDropKey]*udpDropEntry{},
+		lastPrune: time.Now(),
+		lock:      &sync.Mutex{},
+	}
+}
+
+func (l *udpDropLog) drop(mode ProtoHackersMode, addr net.Addr, reason string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+
+	k := udpDropKey{mode: mode, ip: remoteIP(addr), reason: reason}
+	e, ok := l.entries[k]
+	if !ok {
+		e = &udpDropEntry{}
+		l.entries[k] = e
+	}
+	e.unlogged++
+
+	if !ok || now.Sub(e.lastLog) >= udpPruneInterval {
+		l.log(k, e.unlogged)
+		e.lastLog = now
+		e.unlogged = 0
+	}
+
+	// forget the senders not logged for a while, reporting their last drops
+	if now.Sub(l.lastPrune) >= udpPruneInterval {
+		for k, e := range l.entries {
+			if now.Sub(e.lastLog) >= udpPruneInterval {
+				if e.unlogged > 0 {
+					l.log(k, e.unlogged)
+				}
+				delete(l.entries, k)
+			}
+		}
+		l.lastPrune = now
+	}
+}
+
+func (l *udpDropLog) log(k udpDropKey, count int) {
+	l.logger.Warn("datagrams rejected",
+		zap.String("mode", string(k.mode)),
+		zap.String("remote", k.ip),
+		zap.String("reason", k.reason),
+		zap.Int("count", count),
+	)
+}
+
+// datagramDropped counts a datagram dropped by a udp listener and logs it when its sender is due a log
+func (s *Server) datagramDropped(mode ProtoHackersMode, addr net.Addr, reason string) {
+	s.metrics.udpDropped.Inc(string(mode), reason)
+	s.udpDropLog.drop(mode, addr, reason)
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/didil/protohackers/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+
+	// burst
+	assert.True(t, b.allow(now))
+	assert.True(t, b.allow(now))
+	assert.True(t, b.allow(now))
+	assert.False(t, b.allow(now))
+	assert.False(t, b.full(now))
+
+	// 2 tokens per second
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, b.allow(now))
+	assert.False(t, b.allow(now))
+
+	// never more than the burst
+	now = now.Add(time.Hour)
+	assert.True(t, b.full(now))
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.allow(now))
+	}
+	assert.False(t, b.allow(now))
+}
+
+func TestUDPRateLimiterPrune(t *testing.T) {
+	oldPruneInterval := udpPruneInterval
+	udpPruneInterval = 0
+	defer func() { udpPruneInterval = oldPruneInterval }()
+
+	l := newUDPRateLimiter(1000, 1)
+	assert.True(t, l.allow("10.0.0.1"))
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, l.allow("10.0.0.2"))
+
+	// the refilled bucket of 10.0.0.1 was dropped
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestMaxConns(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	s, err := NewServer(ProtoHackersModeEcho, 35000, logger, WithMaxConns(2))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conns := []*net.TCPConn{}
+	for i := 0; i < 3; i++ {
+		conn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+		assert.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, s.ActiveConnections())
+
+	// the third connection is closed right away
+	conns[2].SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conns[2].Read(make([]byte, 1))
+	assert.Error(t, err)
+
+	rejected := logs.FilterMessage("connection rejected").All()
+	assert.Len(t, rejected, 1)
+	assert.Equal(t, "too many connections", rejected[0].ContextMap()["reason"])
+	assert.Equal(t, conns[2].LocalAddr().String(), rejected[0].ContextMap()["remote"])
+
+	// a slot is freed when a connection ends
+	conns[0].Close()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ABC"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.CloseWrite())
+
+	readData, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "ABC", string(readData))
+
+	done <- true
+	<-stopped
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	s, err := NewServer(ProtoHackersModeEcho, 35000, logger, WithMaxConnsPerIP(1))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn1, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.NoError(t, err)
+	defer conn1.Close()
+
+	conn2, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.NoError(t, err)
+	defer conn2.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, s.ActiveConnections())
+
+	rejected := logs.FilterMessage("connection rejected").All()
+	assert.Len(t, rejected, 1)
+	assert.Equal(t, "too many connections from remote ip", rejected[0].ContextMap()["reason"])
+
+	done <- true
+	<-stopped
+}
+
+func TestUDPRateLimit(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	s, err := NewServer(ProtoHackersModeUnusualDatabase, 35000, logger,
+		WithUnusualDbService(services.NewUnusualDbService()),
+		WithUDPRateLimit(0.1, 2),
+	)
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	udpConn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.NoError(t, err)
+	defer udpConn.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err = udpConn.Write([]byte("version"))
+		assert.NoError(t, err)
+	}
+
+	// only the burst is answered
+	outputData := make([]byte, DefaultUDMaxContentSize)
+	for i := 0; i < 2; i++ {
+		udpConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := udpConn.Read(outputData)
+		assert.NoError(t, err)
+		assert.Equal(t, "version=Ken's Key-Value Store 1.0", string(outputData[:n]))
+	}
+
+	udpConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = udpConn.Read(outputData)
+	assert.Error(t, err)
+
+	assert.Equal(t, float64(3), s.metrics.udpDropped.Value(string(ProtoHackersModeUnusualDatabase), udpDropRateLimit))
+
+	// only the first drop is logged until the next prune
+	rejected := logs.FilterMessage("datagrams rejected").All()
+	assert.Len(t, rejected, 1)
+	assert.Equal(t, "127.0.0.1", rejected[0].ContextMap()["remote"])
+	assert.Equal(t, udpDropRateLimit, rejected[0].ContextMap()["reason"])
+	assert.Equal(t, int64(1), rejected[0].ContextMap()["count"])
+
+	done <- true
+	<-stopped
+}
+
+func TestUDPDropLog(t *testing.T) {
+	oldPruneInterval := udpPruneInterval
+	udpPruneInterval = 50 * time.Millisecond
+	defer func() { udpPruneInterval = oldPruneInterval }()
+
+	core, logs := observer.New(zap.InfoLevel)
+	l := newUDPDropLog(zap.New(core))
+
+	mode := ProtoHackersMode(ProtoHackersModeUnusualDatabase)
+	alice := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}
+	bob := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 5000}
+
+	for i := 0; i < 3; i++ {
+		l.drop(mode, alice, udpDropRateLimit)
+	}
+	l.drop(mode, alice, udpDropWorkersBusy)
+	l.drop(mode, bob, udpDropRateLimit)
+	l.drop(mode, bob, udpDropRateLimit)
+
+	counts := func() map[string]int64 {
+		m := map[string]int64{}
+		for _, e := range logs.TakeAll() {
+			ctx := e.ContextMap()
+			m[ctx["remote"].(string)+" "+ctx["reason"].(string)] = ctx["count"].(int64)
+		}
+		return m
+	}
+
+	// the first drop of each ip and reason
+	assert.Equal(t, map[string]int64{
+		"192.0.2.1 rate_limit":   1,
+		"192.0.2.1 workers_busy": 1,
+		"192.0.2.2 rate_limit":   1,
+	}, counts())
+
+	time.Sleep(60 * time.Millisecond)
+
+	// alice's drops since the first log are reported with the next one,
+	// bob's are reported once the log is pruned
+	l.drop(mode, alice, udpDropRateLimit)
+	assert.Equal(t, map[string]int64{
+		"192.0.2.1 rate_limit": 3,
+		"192.0.2.2 rate_limit": 1,
+	}, counts())
+	assert.Len(t, l.entries, 1)
+}
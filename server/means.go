@@ -10,6 +10,14 @@ import (
 	"go.uber.org/zap"
 )
 
+const ProtoHackersModeMeans = "means"
+
+func init() {
+	RegisterMode(ProtoHackersModeMeans, TransportTCP, func(s *Server) (Handler, error) {
+		return HandlerFunc(s.HandleMeans), nil
+	})
+}
+
 type PriceRequestType byte
 
 const (
@@ -36,24 +44,24 @@ func (s *Server) HandleMeans(ctx context.Context, conn net.Conn) {
 
 	db := []*PriceDBEntry{}
 
-	var totalRead int
-	var totalWritten int
+	stats := connStatsFromContext(ctx)
 
-	for {
-		n, err := io.ReadFull(conn, data)
-		if err == io.EOF {
+	for ctx.Err() == nil {
+		_, err := io.ReadFull(conn, data)
+		if err == io.EOF || ctx.Err() != nil {
 			break
 		}
 		if err != nil {
-			s.logger.Error("HandleMeans read error", zap.Error(err))
+			s.handlerError(ProtoHackersModeMeans, "HandleMeans read error", zap.Error(err))
 			break
 		}
 
-		totalRead += n
+		stats.messageIn()
 
 		req, err := parsePriceRequest(data)
 		if err != nil {
-			s.logger.Error("HandleMeans parsePriceRequest error", zap.Error(err))
+			stats.setCloseReason("invalid request")
+			s.handlerError(ProtoHackersModeMeans, "HandleMeans parsePriceRequest error", zap.Error(err))
 			break
 		}
 
@@ -65,27 +73,19 @@ func (s *Server) HandleMeans(ctx context.Context, conn net.Conn) {
 			respData := make([]byte, 4)
 			binary.BigEndian.PutUint32(respData, uint32(avP))
 
-			p, err := conn.Write(respData)
+			_, err := conn.Write(respData)
 			if err != nil {
-				s.logger.Error("HandleMeans write error", zap.Error(err))
+				s.handlerError(ProtoHackersModeMeans, "HandleMeans write error", zap.Error(err))
 				break
 			}
 
-			totalWritten += p
+			stats.messageOut()
 		} else {
-			s.logger.Error("HandleMeans unknown query type error", zap.String("requestType", string(req.RequestType)))
+			s.handlerError(ProtoHackersModeMeans, "HandleMeans unknown query type error", zap.String("requestType", string(req.RequestType)))
 			break
 		}
 
 	}
-
-	reqID, _ := ctx.Value(reqIDContextKey).(string)
-	s.logger.Info("means results",
-		zap.String("reqID", reqID),
-		zap.String("remote", conn.RemoteAddr().String()),
-		zap.Int("totalRead", totalRead),
-		zap.Int("totalWritten", totalWritten),
-	)
 }
 
 func parsePriceRequest(data []byte) (*PriceRequest, error) {
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/didil/protohackers/metrics"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type serverMetrics struct {
+	activeConns      *metrics.Gauge
+	bytesRead        *metrics.Counter
+	bytesWritten     *metrics.Counter
+	handlerErrors    *metrics.Counter
+	primeRequests    *metrics.Counter
+	ticketsDelivered *metrics.Counter
+	udpDropped       *metrics.Counter
+}
+
+func newServerMetrics(s *Server, registry *metrics.Registry) *serverMetrics {
+	m := &serverMetrics{
+		activeConns:      registry.NewGauge("protohackers_active_connections", "Active tcp connections.", "mode"),
+		bytesRead:        registry.NewCounter("protohackers_bytes_read_total", "Bytes received from clients.", "mode"),
+		bytesWritten:     registry.NewCounter("protohackers_bytes_written_total", "Bytes sent to clients.", "mode"),
+		handlerErrors:    registry.NewCounter("protohackers_handler_errors_total", "Errors ending or affecting a client request.", "mode"),
+		primeRequests:    registry.NewCounter("protohackers_prime_requests_total", "Prime time requests by result.", "result"),
+		ticketsDelivered: registry.NewCounter("protohackers_speed_daemon_tickets_delivered_total", "Speed daemon tickets sent to dispatchers."),
+		udpDropped:       registry.NewCounter("protohackers_udp_datagrams_dropped_total", "Udp datagrams dropped, over the rate limit or because all the workers were busy.", "mode", "reason"),
+	}
+
+	registry.NewGaugeFunc("protohackers_chat_users", "Users in the budget chat.", func() float64 {
+		if s.chatSvc == nil {
+			return 0
+		}
+		return float64(len(s.chatSvc.ListCurrentUsersNames()))
+	})
+	registry.NewGaugeFunc("protohackers_ud_keys", "Keys stored in the unusual database.", func() float64 {
+		if s.unusualDbSvc == nil {
+			return 0
+		}
+		return float64(s.unusualDbSvc.Len())
+	})
+
+	return m
+}
+
+// handlerError logs an error raised while serving a client of mode and counts it
+func (s *Server) handlerError(mode ProtoHackersMode, msg string, fields ...zap.Field) {
+	s.metrics.handlerErrors.Inc(string(mode))
+	s.logger.Error(msg, fields...)
+}
+
+// StartMetrics serves the metrics on addr at /metrics
+func (s *Server) StartMetrics(addr string) (io.Closer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start metrics listener")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metricsRegistry.Handler())
+	httpServer := &http.Server{Handler: mux}
+
+	s.logger.Sugar().Infof("Metrics listening on %s ...", listener.Addr())
+
+	go func() {
+		err := httpServer.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("metrics server error", zap.Error(err))
+		}
+	}()
+
+	return httpServer, nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/didil/protohackers/metrics"
+	"github.com/didil/protohackers/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestMetrics(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	registry := metrics.NewRegistry()
+
+	s, err := NewMultiServer([]Listener{
+		{Mode: ProtoHackersModeEcho, Port: 35000},
+		{Mode: ProtoHackersModePrimeTime, Port: 35001},
+	}, logger,
+		WithUnusualDbService(services.NewUnusualDbService()),
+		WithMetricsRegistry(registry),
+		WithMetricsAddr("127.0.0.1:35090"),
+	)
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	echoConn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.NoError(t, err)
+	defer echoConn.Close()
+
+	_, err = echoConn.Write([]byte("ABCD"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(echoConn, make([]byte, 4))
+	assert.NoError(t, err)
+
+	primeConn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35001})
+	assert.NoError(t, err)
+	defer primeConn.Close()
+
+	_, err = primeConn.Write([]byte("{\"method\":\"isPrime\",\"number\":3}\n{\"method\":\"isPrime\",\"number\":4}\n{}\n"))
+	assert.NoError(t, err)
+
+	sc := bufio.NewScanner(primeConn)
+	assert.True(t, sc.Scan())
+	assert.True(t, sc.Scan())
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://127.0.0.1:35090/metrics")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	assert.Contains(t, string(body), `protohackers_active_connections{mode="echo"} 1`)
+	assert.Contains(t, string(body), `protohackers_active_connections{mode="prime"} 0`)
+	assert.Contains(t, string(body), `protohackers_bytes_read_total{mode="echo"} 4`)
+	assert.Contains(t, string(body), `protohackers_bytes_written_total{mode="echo"} 4`)
+	assert.Contains(t, string(body), `protohackers_prime_requests_total{result="prime"} 1`)
+	assert.Contains(t, string(body), `protohackers_prime_requests_total{result="not_prime"} 1`)
+	assert.Contains(t, string(body), `protohackers_prime_requests_total{result="malformed"} 1`)
+	assert.Contains(t, string(body), `protohackers_handler_errors_total{mode="prime"} 1`)
+	assert.Contains(t, string(body), "protohackers_ud_keys 1\n")
+	assert.Contains(t, string(body), "protohackers_chat_users 0\n")
+
+	done <- true
+	<-stopped
+
+	// the metrics listener stops with the others
+	_, err = http.Get("http://127.0.0.1:35090/metrics")
+	assert.Error(t, err)
+}
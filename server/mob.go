@@ -5,33 +5,44 @@ import (
 	"bytes"
 	"context"
 	"net"
-	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+const ProtoHackersModeMobInTheMiddle = "mob"
+
+func init() {
+	RegisterMode(ProtoHackersModeMobInTheMiddle, TransportTCP, func(s *Server) (Handler, error) {
+		return HandlerFunc(s.HandleMobInTheMiddle), nil
+	})
+}
+
 const mobMsgLimit = 1024
 
 func (s *Server) HandleMobInTheMiddle(ctx context.Context, conn net.Conn) {
 	defer conn.Close()
 
-	tcpAddr, err := getMobUpstreamTcpAddr()
+	tcpAddrs, err := s.getMobUpstreamTcpAddrs(ctx)
 	if err != nil {
-		s.logger.Error("getMobUpstreamTcpAddr error", zap.Error(err))
+		s.handlerError(ProtoHackersModeMobInTheMiddle, "getMobUpstreamTcpAddrs error", zap.Error(err))
 		return
 	}
 
-	upstreamConn, err := net.DialTCP("tcp", nil, tcpAddr)
+	rawUpstreamConn, err := dialMobUpstream(ctx, tcpAddrs)
 	if err != nil {
-		s.logger.Error("chat server connect error", zap.Error(err))
+		s.handlerError(ProtoHackersModeMobInTheMiddle, "chat server connect error", zap.Error(err))
 		return
 	}
+	upstreamConn := s.wrapConn(ctx, rawUpstreamConn)
 	defer upstreamConn.Close()
 
+	stats := connStatsFromContext(ctx)
+
 	wg := sync.WaitGroup{}
 
 	wg.Add(1)
@@ -40,23 +51,26 @@ func (s *Server) HandleMobInTheMiddle(ctx context.Context, conn net.Conn) {
 		defer upstreamConn.Close()
 		sc := bufio.NewScanner(upstreamConn)
 		sc.Split(ScanLinesNoLastLine)
-		for sc.Scan() {
+		for ctx.Err() == nil && sc.Scan() {
 			msgFromUpstream := sc.Bytes()
 			s.logger.Info("message from upstream", zap.ByteString("msgFromUpstream", msgFromUpstream))
 
 			msgToClient := replaceWithBogusCoin2(string(msgFromUpstream))
 			s.logger.Info("message to client", zap.String("msgToClient", msgToClient))
 
-			_, err = conn.Write([]byte(msgToClient + "\n"))
+			_, err := conn.Write([]byte(msgToClient + "\n"))
 			if err != nil {
-				s.logger.Error("write to client error", zap.Error(err))
+				s.handlerError(ProtoHackersModeMobInTheMiddle, "write to client error", zap.Error(err))
 				break
 			}
+			stats.messageOut()
 		}
 
-		err = sc.Err()
-		if err != nil {
-			s.logger.Error("read from upstream error", zap.Error(err))
+		err := sc.Err()
+		if err != nil && ctx.Err() == nil {
+			s.handlerError(ProtoHackersModeMobInTheMiddle, "read from upstream error", zap.Error(err))
+		} else if err == nil && ctx.Err() == nil {
+			stats.setCloseReason("upstream closed")
 		}
 
 		wg.Done()
@@ -69,23 +83,25 @@ func (s *Server) HandleMobInTheMiddle(ctx context.Context, conn net.Conn) {
 		sc := bufio.NewScanner(conn)
 		sc.Split(ScanLinesNoLastLine)
 
-		for sc.Scan() {
+		for ctx.Err() == nil && sc.Scan() {
+			stats.messageIn()
+
 			msgFromClient := sc.Bytes()
 			s.logger.Info("message from client", zap.ByteString("msgFromClient", msgFromClient))
 
 			msgToUpstream := replaceWithBogusCoin2(string(msgFromClient))
 			s.logger.Info("message to upstream", zap.String("msgToUpstream", msgToUpstream))
 
-			_, err = upstreamConn.Write([]byte(msgToUpstream + "\n"))
+			_, err := upstreamConn.Write([]byte(msgToUpstream + "\n"))
 			if err != nil {
-				s.logger.Error("write to upstream error", zap.Error(err))
+				s.handlerError(ProtoHackersModeMobInTheMiddle, "write to upstream error", zap.Error(err))
 				break
 			}
 		}
 
-		err = sc.Err()
-		if err != nil {
-			s.logger.Error("read from client error", zap.Error(err))
+		err := sc.Err()
+		if err != nil && ctx.Err() == nil {
+			s.handlerError(ProtoHackersModeMobInTheMiddle, "read from client error", zap.Error(err))
 		}
 
 		wg.Done()
@@ -94,33 +110,121 @@ func (s *Server) HandleMobInTheMiddle(ctx context.Context, conn net.Conn) {
 	wg.Wait()
 }
 
-var mobUpstreamPort = 16963
+const DefaultMobUpstreamPort = 16963
+
+// mobUpstreamResolver looks up the chat server ips
+var mobUpstreamResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+} = net.DefaultResolver
 
-func getMobUpstreamTcpAddr() (*net.TCPAddr, error) {
-	var mobUpstreamHost = os.Getenv("MOB_UPSTREAM_HOST")
+// mobUpstreamDialer connects to a chat server address, an attempt gives up after mobUpstreamDialTimeout
+var mobUpstreamDialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+} = &net.Dialer{Timeout: mobUpstreamDialTimeout}
+
+const (
+	mobUpstreamDialTimeout = 5 * time.Second
+	// mobUpstreamFallbackDelay is the head start given to an attempt before the next address is tried alongside it
+	mobUpstreamFallbackDelay = 300 * time.Millisecond
+)
 
-	ips, err := net.LookupIP(mobUpstreamHost)
+// getMobUpstreamTcpAddrs returns the chat server addresses, alternating ipv4 and ipv6 starting with ipv4
+func (s *Server) getMobUpstreamTcpAddrs(ctx context.Context) ([]*net.TCPAddr, error) {
+	ips, err := mobUpstreamResolver.LookupIPAddr(ctx, s.mobUpstreamHost)
 	if err != nil {
 		return nil, errors.Wrapf(err, "chat server dns lookup error")
 	}
 	if len(ips) == 0 {
-		return nil, errors.Wrapf(err, "chat server dns lookup no ips")
+		return nil, errors.New("chat server dns lookup no ips")
 	}
 
-	var ip *net.IP
+	ipv4Addrs := []*net.TCPAddr{}
+	ipv6Addrs := []*net.TCPAddr{}
 
-	for _, x := range ips {
-		if x.To4() != nil {
-			ip = &x
-			break
+	for _, ip := range ips {
+		addr := &net.TCPAddr{IP: ip.IP, Port: s.mobUpstreamPort, Zone: ip.Zone}
+		if ip.IP.To4() != nil {
+			ipv4Addrs = append(ipv4Addrs, addr)
+		} else {
+			ipv6Addrs = append(ipv6Addrs, addr)
+		}
+	}
+
+	addrs := make([]*net.TCPAddr, 0, len(ips))
+	for i := 0; i < len(ipv4Addrs) || i < len(ipv6Addrs); i++ {
+		if i < len(ipv4Addrs) {
+			addrs = append(addrs, ipv4Addrs[i])
 		}
+		if i < len(ipv6Addrs) {
+			addrs = append(addrs, ipv6Addrs[i])
+		}
+	}
+
+	return addrs, nil
+}
+
+type mobDialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialMobUpstream connects to the first chat server address accepting the connection.
+// The addresses are tried in order, an attempt that doesn't succeed within mobUpstreamFallbackDelay
+// races with the next address, so that an unreachable ip family doesn't hold up the other one
+func dialMobUpstream(ctx context.Context, tcpAddrs []*net.TCPAddr) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan mobDialResult, len(tcpAddrs))
+	started, failed := 0, 0
+	startNext := func() {
+		addr := tcpAddrs[started]
+		started++
+		go func() {
+			conn, err := mobUpstreamDialer.DialContext(ctx, "tcp", addr.String())
+			results <- mobDialResult{conn: conn, err: err}
+		}()
 	}
 
-	if ip == nil {
-		return nil, errors.New("couldn't find ipv4 for chat server")
+	startNext()
+
+	var err error
+	for {
+		var fallback <-chan time.Time
+		if started < len(tcpAddrs) {
+			fallback = time.After(mobUpstreamFallbackDelay)
+		}
+
+		select {
+		case r := <-results:
+			if r.err == nil {
+				// close the connections the attempts still running may establish
+				go closeMobDialResults(results, started-failed-1)
+				return r.conn, nil
+			}
+
+			err = r.err
+			failed++
+			if failed == len(tcpAddrs) {
+				return nil, err
+			}
+			if failed == started {
+				// no attempt left running, no need to wait
+				startNext()
+			}
+		case <-fallback:
+			startNext()
+		}
 	}
+}
 
-	return &net.TCPAddr{IP: ips[0], Port: mobUpstreamPort}, nil
+func closeMobDialResults(results chan mobDialResult, n int) {
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.err == nil {
+			r.conn.Close()
+		}
+	}
 }
 
 var tonysAddress = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
@@ -22,8 +23,9 @@ func TestHandleMobInTheMiddle(t *testing.T) {
 
 	done := make(chan bool, 1)
 
-	upstreamListener, err := net.Listen("tcp4", fmt.Sprintf(":%d", mobUpstreamPort))
+	upstreamListener, err := net.Listen("tcp4", fmt.Sprintf(":%d", DefaultMobUpstreamPort))
 	assert.NoError(t, err)
+	defer upstreamListener.Close()
 
 	msgReceivedByMobServer := ""
 	go func() {
@@ -65,6 +67,174 @@ func TestHandleMobInTheMiddle(t *testing.T) {
 
 }
 
+type fakeMobResolver struct {
+	ips []net.IPAddr
+}
+
+func (r *fakeMobResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return r.ips, nil
+}
+
+func TestGetMobUpstreamTcpAddrs(t *testing.T) {
+	defer func(r interface {
+		LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	}) {
+		mobUpstreamResolver = r
+	}(mobUpstreamResolver)
+
+	mobUpstreamResolver = &fakeMobResolver{ips: []net.IPAddr{
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+		{IP: net.ParseIP("2001:db8::2")},
+	}}
+
+	s := &Server{mobUpstreamHost: "chat.protohackers.com", mobUpstreamPort: DefaultMobUpstreamPort}
+
+	addrs, err := s.getMobUpstreamTcpAddrs(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []*net.TCPAddr{
+		{IP: net.ParseIP("192.0.2.1"), Port: DefaultMobUpstreamPort},
+		{IP: net.ParseIP("2001:db8::1"), Port: DefaultMobUpstreamPort},
+		{IP: net.ParseIP("192.0.2.2"), Port: DefaultMobUpstreamPort},
+		{IP: net.ParseIP("2001:db8::2"), Port: DefaultMobUpstreamPort},
+	}, addrs)
+
+	mobUpstreamResolver = &fakeMobResolver{ips: []net.IPAddr{}}
+
+	_, err = s.getMobUpstreamTcpAddrs(context.Background())
+	assert.EqualError(t, err, "chat server dns lookup no ips")
+}
+
+func TestHandleMobInTheMiddleIPv6Fallback(t *testing.T) {
+	defer func(r interface {
+		LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	}) {
+		mobUpstreamResolver = r
+	}(mobUpstreamResolver)
+
+	// the upstream only listens on ipv6, the ipv4 address is refused
+	mobUpstreamResolver = &fakeMobResolver{ips: []net.IPAddr{
+		{IP: net.ParseIP("127.0.0.1")},
+		{IP: net.ParseIP("::1")},
+	}}
+
+	upstreamListener, err := net.Listen("tcp6", fmt.Sprintf("[::1]:%d", DefaultMobUpstreamPort))
+	assert.NoError(t, err)
+	defer upstreamListener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := upstreamListener.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+
+		buff := make([]byte, mobMsgLimit)
+		n, err := conn.Read(buff)
+		assert.NoError(t, err)
+
+		received <- string(buff[:n])
+	}()
+
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	s, err := NewServer(ProtoHackersModeMobInTheMiddle, 35000, logger)
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	tcpConn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.NoError(t, err)
+	defer tcpConn.Close()
+
+	_, err = tcpConn.Write([]byte("[PinkCoder342] Hi\n"))
+	assert.NoError(t, err)
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "[PinkCoder342] Hi\n", msg)
+	case <-time.After(time.Second):
+		assert.Fail(t, "upstream didn't receive the message")
+	}
+
+	done <- true
+	<-stopped
+}
+
+// blackholeMobDialer never connects to the blackholed addresses, it waits for the attempt to be abandoned
+type blackholeMobDialer struct {
+	blackholed string
+	abandoned  chan bool
+}
+
+func (d *blackholeMobDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if address == d.blackholed {
+		<-ctx.Done()
+		d.abandoned <- true
+		return nil, ctx.Err()
+	}
+
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func TestDialMobUpstreamBlackholed(t *testing.T) {
+	defer func(d interface {
+		DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+	}) {
+		mobUpstreamDialer = d
+	}(mobUpstreamDialer)
+
+	assert.Equal(t, mobUpstreamDialTimeout, mobUpstreamDialer.(*net.Dialer).Timeout)
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	blackholed := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: DefaultMobUpstreamPort}
+	dialer := &blackholeMobDialer{blackholed: blackholed.String(), abandoned: make(chan bool, 1)}
+	mobUpstreamDialer = dialer
+
+	start := time.Now()
+	conn, err := dialMobUpstream(context.Background(), []*net.TCPAddr{blackholed, listener.Addr().(*net.TCPAddr)})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// the second address is tried once the first one got its head start
+	assert.Less(t, time.Since(start), mobUpstreamFallbackDelay+time.Second)
+	assert.Equal(t, listener.Addr().String(), conn.RemoteAddr().String())
+
+	select {
+	case <-dialer.abandoned:
+	case <-time.After(time.Second):
+		assert.Fail(t, "blackholed attempt not abandoned")
+	}
+}
+
+func TestDialMobUpstreamAllFail(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	// refused attempts don't wait for the fallback delay
+	start := time.Now()
+	_, err = dialMobUpstream(context.Background(), []*net.TCPAddr{addr, addr, addr})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), mobUpstreamFallbackDelay)
+}
+
 func TestReplaceWithBogusCoin(t *testing.T) {
 	assert.Equal(t, "Hi alice, please send payment to 7YWHMfk9JZe0LM0g1ZauHuiSxhI", replaceWithBogusCoin2("Hi alice, please send payment to 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX"))
 	assert.Equal(t, "Hi alice, please send payment to 7YWHMfk9JZe0LM0g1ZauHuiSxhI ok 7YWHMfk9JZe0LM0g1ZauHuiSxhI ?", replaceWithBogusCoin2("Hi alice, please send payment to 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX ok 7mQ06fryM9E3IXQ1tR6RSNdIn9qcLwkxedp ?"))
@@ -11,6 +11,21 @@ import (
 	"go.uber.org/zap"
 )
 
+const ProtoHackersModePrimeTime = "prime"
+
+func init() {
+	RegisterMode(ProtoHackersModePrimeTime, TransportTCP, func(s *Server) (Handler, error) {
+		return HandlerFunc(s.HandlePrimeTime), nil
+	})
+}
+
+// prime requests metric results
+const (
+	primeRequestResultPrime     = "prime"
+	primeRequestResultNotPrime  = "not_prime"
+	primeRequestResultMalformed = "malformed"
+)
+
 type PrimeTimeRequest struct {
 	Method *string          `json:"method"`
 	Number *json.RawMessage `json:"number"`
@@ -26,22 +41,28 @@ func (s *Server) HandlePrimeTime(ctx context.Context, conn net.Conn) {
 
 	sc := bufio.NewScanner(conn)
 
-	numRequests := 0
+	stats := connStatsFromContext(ctx)
+
+	for ctx.Err() == nil && sc.Scan() {
+		stats.messageIn()
 
-	for sc.Scan() {
 		req := &PrimeTimeRequest{}
 		data := sc.Bytes()
 		s.logger.Info("HandlePrimeTime request", zap.ByteString("data", data))
 
 		err := json.Unmarshal(data, req)
 		if err != nil {
-			s.logger.Error("HandlePrimeTime unmarshall error", zap.ByteString("data", data), zap.Error(err))
+			s.metrics.primeRequests.Inc(primeRequestResultMalformed)
+			stats.setCloseReason("malformed request")
+			s.handlerError(ProtoHackersModePrimeTime, "HandlePrimeTime unmarshall error", zap.ByteString("data", data), zap.Error(err))
 			conn.Write([]byte("ERROR"))
 			return
 		}
 
 		if !isValidPrimeRequest(req) {
-			s.logger.Error("HandlePrimeTime invalid prime request", zap.ByteString("data", data), zap.Error(err))
+			s.metrics.primeRequests.Inc(primeRequestResultMalformed)
+			stats.setCloseReason("malformed request")
+			s.handlerError(ProtoHackersModePrimeTime, "HandlePrimeTime invalid prime request", zap.ByteString("data", data), zap.Error(err))
 			conn.Write([]byte("ERROR"))
 			return
 		}
@@ -51,9 +72,15 @@ func (s *Server) HandlePrimeTime(ctx context.Context, conn net.Conn) {
 			Prime:  isPrime(*req.Number),
 		}
 
+		if resp.Prime {
+			s.metrics.primeRequests.Inc(primeRequestResultPrime)
+		} else {
+			s.metrics.primeRequests.Inc(primeRequestResultNotPrime)
+		}
+
 		out, err := json.Marshal(resp)
 		if err != nil {
-			s.logger.Error("HandlePrimeTime marshal error", zap.Error(err))
+			s.handlerError(ProtoHackersModePrimeTime, "HandlePrimeTime marshal error", zap.Error(err))
 			break
 		}
 
@@ -61,26 +88,17 @@ func (s *Server) HandlePrimeTime(ctx context.Context, conn net.Conn) {
 
 		_, err = conn.Write(out)
 		if err != nil {
-			s.logger.Error("HandlePrimeTime write error", zap.Error(err))
+			s.handlerError(ProtoHackersModePrimeTime, "HandlePrimeTime write error", zap.Error(err))
 			break
 		}
 
-		numRequests++
+		stats.messageOut()
 	}
 
 	err := sc.Err()
-	if err != nil {
-		s.logger.Error("HandlePrimeTime scan error", zap.Error(err))
-		return
-
+	if err != nil && ctx.Err() == nil {
+		s.handlerError(ProtoHackersModePrimeTime, "HandlePrimeTime scan error", zap.Error(err))
 	}
-
-	reqID, _ := ctx.Value(reqIDContextKey).(string)
-	s.logger.Info("prime time results",
-		zap.String("reqID", reqID),
-		zap.String("remote", conn.RemoteAddr().String()),
-		zap.Int("numRequests", numRequests),
-	)
 }
 
 func isValidPrimeRequest(req *PrimeTimeRequest) bool {
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+type Transport string
+
+const (
+	TransportTCP Transport = "tcp"
+	TransportUDP Transport = "udp"
+)
+
+// Handler serves a protocol mode.
+// For tcp modes, Serve is called for every accepted connection, wrapped to apply the server timeouts and count its traffic.
+// For udp modes, Serve is called once with the listening connection and returns when it is closed.
+// It implements net.PacketConn, and drops the datagrams over the rate limit when one is set, so it is not always a *net.UDPConn.
+type Handler interface {
+	Serve(ctx context.Context, conn net.Conn)
+}
+
+// HandlerFunc adapts a function to the Handler interface
+type HandlerFunc func(ctx context.Context, conn net.Conn)
+
+func (f HandlerFunc) Serve(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
+// HandlerConstructor builds the handler of a mode for a server, once per listener
+type HandlerConstructor func(s *Server) (Handler, error)
+
+type modeRegistration struct {
+	transport  Transport
+	newHandler HandlerConstructor
+}
+
+var (
+	registry     = map[ProtoHackersMode]*modeRegistration{}
+	registryLock = &sync.RWMutex{}
+)
+
+// RegisterMode makes a mode available to servers, it panics if the mode is already registered.
+// It is meant to be called from the init function of the package implementing the mode
+func RegisterMode(mode ProtoHackersMode, transport Transport, newHandler HandlerConstructor) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if transport != TransportTCP && transport != TransportUDP {
+		panic(fmt.Sprintf("invalid transport %s for mode %s", transport, mode))
+	}
+	if newHandler == nil {
+		panic(fmt.Sprintf("nil handler constructor for mode %s", mode))
+	}
+	if _, ok := registry[mode]; ok {
+		panic(fmt.Sprintf("mode already registered: %s", mode))
+	}
+
+	registry[mode] = &modeRegistration{
+		transport:  transport,
+		newHandler: newHandler,
+	}
+}
+
+// unregisterMode removes a mode registered by a test, so that the test can run again
+func unregisterMode(mode ProtoHackersMode) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	delete(registry, mode)
+}
+
+// RegisteredModes returns the registered modes, sorted by name
+func RegisteredModes() []ProtoHackersMode {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	modes := make([]ProtoHackersMode, 0, len(registry))
+	for mode := range registry {
+		modes = append(modes, mode)
+	}
+
+	sort.Slice(modes, func(i, j int) bool { return modes[i] < modes[j] })
+
+	return modes
+}
+
+func lookupMode(mode ProtoHackersMode) *modeRegistration {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	return registry[mode]
+}
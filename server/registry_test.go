@@ -0,0 +1,112 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRegisteredModes(t *testing.T) {
+	modes := RegisteredModes()
+
+	for _, mode := range []ProtoHackersMode{
+		ProtoHackersModeEcho,
+		ProtoHackersModePrimeTime,
+		ProtoHackersModeMeans,
+		ProtoHackersModeBudgetChat,
+		ProtoHackersModeUnusualDatabase,
+		ProtoHackersModeMobInTheMiddle,
+		ProtoHackersModeSpeedDaemon,
+	} {
+		assert.Contains(t, modes, mode)
+		assert.True(t, isValidMode(string(mode)))
+	}
+
+	assert.False(t, isValidMode("chess"))
+	assert.Equal(t, TransportUDP, lookupMode(ProtoHackersModeUnusualDatabase).transport)
+	assert.Equal(t, TransportTCP, lookupMode(ProtoHackersModeEcho).transport)
+}
+
+func TestRegisterModeInvalid(t *testing.T) {
+	newHandler := func(s *Server) (Handler, error) {
+		return HandlerFunc(func(ctx context.Context, conn net.Conn) {}), nil
+	}
+
+	assert.PanicsWithValue(t, "mode already registered: echo", func() {
+		RegisterMode(ProtoHackersModeEcho, TransportTCP, newHandler)
+	})
+	assert.PanicsWithValue(t, "invalid transport sctp for mode test-invalid", func() {
+		RegisterMode("test-invalid", "sctp", newHandler)
+	})
+	assert.PanicsWithValue(t, "nil handler constructor for mode test-invalid", func() {
+		RegisterMode("test-invalid", TransportTCP, nil)
+	})
+}
+
+// upperHandler is a mode defined outside of server.go, the way another package would add one
+type upperHandler struct {
+	logger *zap.Logger
+}
+
+func (h *upperHandler) Serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		line := []byte(sc.Text() + "\n")
+		for i, c := range line {
+			if c >= 'a' && c <= 'z' {
+				line[i] = c - 'a' + 'A'
+			}
+		}
+
+		_, err := conn.Write(line)
+		if err != nil {
+			h.logger.Error("upper write error", zap.Error(err))
+			return
+		}
+	}
+}
+
+func TestRegisterMode(t *testing.T) {
+	mode := ProtoHackersMode("test-upper")
+	RegisterMode(mode, TransportTCP, func(s *Server) (Handler, error) {
+		return &upperHandler{logger: s.Logger()}, nil
+	})
+	t.Cleanup(func() { unregisterMode(mode) })
+
+	port := 35000
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	s, err := NewServer(string(mode), port, logger)
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello\n"))
+	assert.NoError(t, err)
+
+	sc := bufio.NewScanner(conn)
+	assert.True(t, sc.Scan())
+	assert.Equal(t, "HELLO", sc.Text())
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
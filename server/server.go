@@ -2,63 +2,178 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/didil/protohackers/metrics"
 	"github.com/didil/protohackers/services"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
-	"golang.org/x/exp/slices"
 )
 
 type ProtoHackersMode string
 
+// AddressFamily selects the ip versions the listeners accept
+type AddressFamily string
+
+const (
+	AddressFamilyIPv4      AddressFamily = "ipv4"
+	AddressFamilyIPv6      AddressFamily = "ipv6"
+	AddressFamilyDualStack AddressFamily = "dual"
+)
+
+// Listener binds a mode to a port
+type Listener struct {
+	Mode ProtoHackersMode
+	Port int
+}
+
 type Server struct {
-	mode           ProtoHackersMode
-	port           int
+	listeners      []Listener
 	logger         *zap.Logger
 	chatSvc        services.ChatService
 	unusualDbSvc   services.UnusualDbService
 	speedDaemonSvc services.SpeedDaemonService
+	// ctx is the parent of the handlers contexts, cancelled when the server shuts down
+	ctx    context.Context
+	cancel context.CancelFunc
+	// listeners bind bindAddress, all interfaces if empty, for the ip versions of addressFamily
+	bindAddress   string
+	addressFamily AddressFamily
+	// how long connections are given to end on their own during shutdown
+	drainTimeout time.Duration
+	// connections without data from the peer for idleTimeout are ended, 0 means no limit
+	idleTimeout time.Duration
+	// writes not completed within writeTimeout end the connection, 0 means no limit
+	writeTimeout time.Duration
+	// maximum number of concurrent tcp connections, 0 means no limit
+	maxConns int
+	// maximum number of concurrent tcp connections from a single remote ip, 0 means no limit
+	maxConnsPerIP int
+	// datagrams per second allowed from a single remote ip, with bursts of udpBurst, 0 means no limit
+	udpRate  float64
+	udpBurst int
+	// metricsRegistry holds the server metrics, served over http on metricsAddr if set
+	metricsRegistry *metrics.Registry
+	metricsAddr     string
+	metrics         *serverMetrics
+	udpDropLog      *udpDropLog
+	// accessLogger receives a record for every tcp connection closed
+	accessLogger *zap.Logger
+	// chatMessageLimit truncates longer budget chat messages
+	chatMessageLimit int
+	// udMaxContentSize truncates longer unusual database datagrams
+	udMaxContentSize int
+	// udWorkers is the number of unusual database datagrams processed at once, the others are dropped
+	udWorkers int
+	// mob mode chat server
+	mobUpstreamHost string
+	mobUpstreamPort int
+	// tcp connections are served over tls when tlsCertFile and tlsKeyFile are set,
+	// clients must present a certificate signed by tlsClientCAFile if set
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsClientCAFile string
+	tls             *tlsReloader
+	// active tcp connections
+	conns        map[net.Conn]bool
+	connsPerIP   map[string]int
+	connsWg      *sync.WaitGroup
+	shuttingDown bool
+	connsLock    *sync.Mutex
 }
 
 const (
-	ProtoHackersModeEcho            = "echo"
-	ProtoHackersModePrimeTime       = "prime"
-	ProtoHackersModeMeans           = "means"
-	ProtoHackersModeBudgetChat      = "budget_chat"
-	ProtoHackersModeUnusualDatabase = "ud"
-	ProtoHackersModeMobInTheMiddle  = "mob"
-	ProtoHackersModeSpeedDaemon     = "speed-daemon"
+	DefaultDrainTimeout = 10 * time.Second
+	DefaultWriteTimeout = 30 * time.Second
+	// closedConnsExitTimeout bounds the wait for the handlers of the connections closed at the end of the drain
+	closedConnsExitTimeout = 5 * time.Second
 )
 
-var validModes = []ProtoHackersMode{
-	ProtoHackersModeEcho,
-	ProtoHackersModePrimeTime,
-	ProtoHackersModeMeans,
-	ProtoHackersModeBudgetChat,
-	ProtoHackersModeUnusualDatabase,
-	ProtoHackersModeMobInTheMiddle,
-	ProtoHackersModeSpeedDaemon,
-}
-
 type ServerOpt func(*Server) *Server
 
 func NewServer(mode string, port int, logger *zap.Logger, opts ...ServerOpt) (*Server, error) {
-	if !isValidMode(mode) {
-		return nil, fmt.Errorf("invalid mode %s", mode)
+	return NewMultiServer([]Listener{{Mode: ProtoHackersMode(mode), Port: port}}, logger, opts...)
+}
+
+// NewMultiServer returns a server running every listener, sharing the same services
+func NewMultiServer(listeners []Listener, logger *zap.Logger, opts ...ServerOpt) (*Server, error) {
+	if len(listeners) == 0 {
+		return nil, errors.New("no listener")
+	}
+
+	usedPorts := map[string]bool{}
+	for _, l := range listeners {
+		registration := lookupMode(l.Mode)
+		if registration == nil {
+			return nil, fmt.Errorf("invalid mode %s", l.Mode)
+		}
+
+		portKey := fmt.Sprintf("%s/%d", registration.transport, l.Port)
+		if usedPorts[portKey] {
+			return nil, fmt.Errorf("port %s used by several modes", portKey)
+		}
+		usedPorts[portKey] = true
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	s := &Server{
-		mode:   ProtoHackersMode(mode),
-		port:   port,
-		logger: logger,
+		listeners:        listeners,
+		logger:           logger,
+		ctx:              ctx,
+		cancel:           cancel,
+		addressFamily:    AddressFamilyIPv4,
+		drainTimeout:     DefaultDrainTimeout,
+		writeTimeout:     DefaultWriteTimeout,
+		chatMessageLimit: DefaultChatMessageLimit,
+		udMaxContentSize: DefaultUDMaxContentSize,
+		udWorkers:        DefaultUDWorkers,
+		mobUpstreamHost:  os.Getenv("MOB_UPSTREAM_HOST"),
+		mobUpstreamPort:  DefaultMobUpstreamPort,
+		conns:            map[net.Conn]bool{},
+		connsPerIP:       map[string]int{},
+		connsWg:          &sync.WaitGroup{},
+		connsLock:        &sync.Mutex{},
 	}
 
 	for _, opt := range opts {
 		s = opt(s)
 	}
 
+	err := validateBindAddress(s.bindAddress, s.addressFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.tlsCertFile != "" || s.tlsKeyFile != "" {
+		tlsReloader, err := newTLSReloader(s.tlsCertFile, s.tlsKeyFile, s.tlsClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		s.tls = tlsReloader
+	} else if s.tlsClientCAFile != "" {
+		return nil, errors.New("tls client ca set without tls certificate")
+	}
+
+	if s.accessLogger == nil {
+		s.accessLogger = logger
+	}
+
+	if s.metricsRegistry == nil {
+		s.metricsRegistry = metrics.NewRegistry()
+	}
+	s.metrics = newServerMetrics(s, s.metricsRegistry)
+	s.udpDropLog = newUDPDropLog(s.logger)
+
 	return s, nil
 }
 
@@ -76,6 +191,148 @@ func WithUnusualDbService(unusualDbSvc services.UnusualDbService) ServerOpt {
 	}
 }
 
+// WithBindAddress makes the listeners bind a single ip instead of all interfaces
+func WithBindAddress(bindAddress string) ServerOpt {
+	return func(s *Server) *Server {
+		s.bindAddress = bindAddress
+		return s
+	}
+}
+
+// WithAddressFamily makes the listeners accept ipv4, ipv6 or both, ipv4 by default
+func WithAddressFamily(addressFamily AddressFamily) ServerOpt {
+	return func(s *Server) *Server {
+		s.addressFamily = addressFamily
+		return s
+	}
+}
+
+// WithDrainTimeout sets how long connections are given to end on their own during shutdown,
+// before they are closed forcibly
+func WithDrainTimeout(drainTimeout time.Duration) ServerOpt {
+	return func(s *Server) *Server {
+		s.drainTimeout = drainTimeout
+		return s
+	}
+}
+
+// WithIdleTimeout ends connections that receive nothing from the peer for idleTimeout, 0 disables it
+func WithIdleTimeout(idleTimeout time.Duration) ServerOpt {
+	return func(s *Server) *Server {
+		s.idleTimeout = idleTimeout
+		return s
+	}
+}
+
+// WithWriteTimeout ends connections whose writes don't complete within writeTimeout, 0 disables it
+func WithWriteTimeout(writeTimeout time.Duration) ServerOpt {
+	return func(s *Server) *Server {
+		s.writeTimeout = writeTimeout
+		return s
+	}
+}
+
+// WithMaxConns caps the number of concurrent tcp connections, 0 disables it
+func WithMaxConns(maxConns int) ServerOpt {
+	return func(s *Server) *Server {
+		s.maxConns = maxConns
+		return s
+	}
+}
+
+// WithMaxConnsPerIP caps the number of concurrent tcp connections from a single remote ip, 0 disables it
+func WithMaxConnsPerIP(maxConnsPerIP int) ServerOpt {
+	return func(s *Server) *Server {
+		s.maxConnsPerIP = maxConnsPerIP
+		return s
+	}
+}
+
+// WithUDPRateLimit allows rate datagrams per second from a single remote ip, with bursts of up to burst datagrams.
+// Datagrams over the limit are dropped, a rate of 0 disables it
+func WithUDPRateLimit(rate float64, burst int) ServerOpt {
+	return func(s *Server) *Server {
+		s.udpRate = rate
+		s.udpBurst = burst
+		return s
+	}
+}
+
+// WithChatMessageLimit truncates budget chat messages longer than chatMessageLimit bytes
+func WithChatMessageLimit(chatMessageLimit int) ServerOpt {
+	return func(s *Server) *Server {
+		s.chatMessageLimit = chatMessageLimit
+		return s
+	}
+}
+
+// WithUDMaxContentSize truncates unusual database datagrams longer than udMaxContentSize bytes
+func WithUDMaxContentSize(udMaxContentSize int) ServerOpt {
+	return func(s *Server) *Server {
+		s.udMaxContentSize = udMaxContentSize
+		return s
+	}
+}
+
+// WithUDWorkers sets the number of unusual database datagrams processed at once,
+// datagrams received while they are all busy are dropped
+func WithUDWorkers(udWorkers int) ServerOpt {
+	return func(s *Server) *Server {
+		s.udWorkers = udWorkers
+		return s
+	}
+}
+
+// WithMobUpstream sets the chat server proxied by the mob mode, MOB_UPSTREAM_HOST port 16963 by default
+func WithMobUpstream(host string, port int) ServerOpt {
+	return func(s *Server) *Server {
+		s.mobUpstreamHost = host
+		s.mobUpstreamPort = port
+		return s
+	}
+}
+
+// WithAccessLogger writes the connections access log records to accessLogger instead of the server logger
+func WithAccessLogger(accessLogger *zap.Logger) ServerOpt {
+	return func(s *Server) *Server {
+		s.accessLogger = accessLogger
+		return s
+	}
+}
+
+// WithMetricsRegistry registers the server metrics in registry, so that they can be served along others
+func WithMetricsRegistry(registry *metrics.Registry) ServerOpt {
+	return func(s *Server) *Server {
+		s.metricsRegistry = registry
+		return s
+	}
+}
+
+// WithMetricsAddr serves the metrics over http on addr, e.g. ":9100"
+func WithMetricsAddr(addr string) ServerOpt {
+	return func(s *Server) *Server {
+		s.metricsAddr = addr
+		return s
+	}
+}
+
+// WithTLS serves every tcp mode over tls with the certificate and key files, reloaded by ReloadTLS
+func WithTLS(certFile string, keyFile string) ServerOpt {
+	return func(s *Server) *Server {
+		s.tlsCertFile = certFile
+		s.tlsKeyFile = keyFile
+		return s
+	}
+}
+
+// WithTLSClientCA requires tls clients to present a certificate signed by the authorities in caFile
+func WithTLSClientCA(caFile string) ServerOpt {
+	return func(s *Server) *Server {
+		s.tlsClientCAFile = caFile
+		return s
+	}
+}
+
 func WithSpeedDaemonDbService(speedDaemonSvc services.SpeedDaemonService) ServerOpt {
 	return func(s *Server) *Server {
 		s.speedDaemonSvc = speedDaemonSvc
@@ -84,39 +341,206 @@ func WithSpeedDaemonDbService(speedDaemonSvc services.SpeedDaemonService) Server
 }
 
 func isValidMode(mode string) bool {
-	return slices.Contains(validModes, ProtoHackersMode(mode))
+	return lookupMode(ProtoHackersMode(mode)) != nil
+}
+
+// Logger gives handlers of modes registered outside of this package access to the server logger
+func (s *Server) Logger() *zap.Logger {
+	return s.logger
+}
+
+// ParseListeners parses a comma separated list of mode:port bindings, e.g. "echo:3000,ud:3001"
+func ParseListeners(bindings string) ([]Listener, error) {
+	listeners := []Listener{}
+
+	for _, binding := range strings.Split(bindings, ",") {
+		binding = strings.TrimSpace(binding)
+		if binding == "" {
+			continue
+		}
+
+		i := strings.LastIndex(binding, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid binding %q, expected mode:port", binding)
+		}
+
+		port, err := strconv.Atoi(binding[i+1:])
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port in binding %q", binding)
+		}
+
+		listeners = append(listeners, Listener{Mode: ProtoHackersMode(binding[:i]), Port: port})
+	}
+
+	return listeners, nil
 }
 
+// Start opens every listener then serves them until done is closed
 func (s *Server) Start(done <-chan bool) error {
+	closers := []io.Closer{}
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
 
-	if s.mode == ProtoHackersModeUnusualDatabase {
-		return s.StartUnusualDatabase(done)
-	} else {
-		return s.StartTCP(done)
+	for _, l := range s.listeners {
+		registration := lookupMode(l.Mode)
+
+		handler, err := registration.newHandler(s)
+		if err != nil {
+			closeAll()
+			return errors.Wrapf(err, "failed to init %s handler", l.Mode)
+		}
+
+		var closer io.Closer
+		if registration.transport == TransportUDP {
+			closer, err = s.StartUDP(l, handler)
+		} else {
+			closer, err = s.StartTCP(l, handler)
+		}
+		if err != nil {
+			closeAll()
+			return err
+		}
+
+		closers = append(closers, closer)
+	}
+
+	if s.metricsAddr != "" {
+		closer, err := s.StartMetrics(s.metricsAddr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+
+		closers = append(closers, closer)
 	}
 
+	<-done
+	s.logger.Sugar().Infof("Received 'done' signal, closing listeners")
+	closeAll()
+
+	s.shutdown()
+
 	return nil
 }
 
-func (s *Server) StartTCP(done <-chan bool) error {
-	addr := fmt.Sprintf(":%d", s.port)
-	listener, err := net.Listen("tcp4", addr)
-	if err != nil {
-		return errors.Wrapf(err, "failed to start listener")
+// shutdown cancels the handlers contexts and waits for the connections to end,
+// closing the ones still open after the drain timeout
+func (s *Server) shutdown() {
+	s.connsLock.Lock()
+	s.shuttingDown = true
+	active := len(s.conns)
+	s.connsLock.Unlock()
+
+	s.cancel()
+
+	drained := make(chan bool)
+	go func() {
+		s.connsWg.Wait()
+		close(drained)
+	}()
+
+	forciblyClosed := 0
+
+	select {
+	case <-drained:
+	case <-time.After(s.drainTimeout):
+		s.connsLock.Lock()
+		for conn := range s.conns {
+			conn.Close()
+			forciblyClosed++
+		}
+		s.connsLock.Unlock()
+
+		// give the handlers of the closed connections time to return, so that they are done
+		// with the services before the caller releases them
+		select {
+		case <-drained:
+		case <-time.After(closedConnsExitTimeout):
+			s.logger.Warn("handlers still running after their connections were closed",
+				zap.Duration("closedConnsExitTimeout", closedConnsExitTimeout),
+			)
+		}
 	}
 
-	s.logger.Sugar().Infof("TCP Server listening on %s / mode: %s ...", addr, s.mode)
+	s.logger.Info("shutdown complete",
+		zap.Int("activeConnections", active),
+		zap.Int("drained", active-forciblyClosed),
+		zap.Int("forciblyClosed", forciblyClosed),
+		zap.Duration("drainTimeout", s.drainTimeout),
+	)
+}
 
-	go s.AcceptTCP(listener)
+// trackConn registers an active connection, or returns why it can't be accepted
+func (s *Server) trackConn(conn net.Conn) error {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
 
-	<-done
-	s.logger.Sugar().Infof("TCP: Received 'done' signal, closing listener")
-	listener.Close()
+	if s.shuttingDown {
+		return errShuttingDown
+	}
+
+	if s.maxConns > 0 && len(s.conns) >= s.maxConns {
+		return errTooManyConns
+	}
+
+	ip := remoteIP(conn.RemoteAddr())
+	if s.maxConnsPerIP > 0 && s.connsPerIP[ip] >= s.maxConnsPerIP {
+		return errTooManyConnsFromIP
+	}
+
+	s.conns[conn] = true
+	s.connsPerIP[ip]++
+	s.connsWg.Add(1)
 
 	return nil
 }
 
-func (s *Server) AcceptTCP(listener net.Listener) {
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+
+	delete(s.conns, conn)
+
+	ip := remoteIP(conn.RemoteAddr())
+	s.connsPerIP[ip]--
+	if s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+
+	s.connsWg.Done()
+}
+
+// ActiveConnections returns the number of tcp connections being handled
+func (s *Server) ActiveConnections() int {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+
+	return len(s.conns)
+}
+
+func (s *Server) StartTCP(l Listener, handler Handler) (io.Closer, error) {
+	addr := net.JoinHostPort(s.bindAddress, strconv.Itoa(l.Port))
+	listener, err := net.Listen(s.network(TransportTCP), addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start listener")
+	}
+
+	if s.tls != nil {
+		listener = tls.NewListener(listener, s.tls.config())
+		s.logger.Sugar().Infof("TLS Server listening on %s / mode: %s ...", addr, l.Mode)
+	} else {
+		s.logger.Sugar().Infof("TCP Server listening on %s / mode: %s ...", addr, l.Mode)
+	}
+
+	go s.AcceptTCP(l.Mode, handler, listener)
+
+	return listener, nil
+}
+
+func (s *Server) AcceptTCP(mode ProtoHackersMode, handler Handler, listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if errors.Is(err, net.ErrClosed) {
@@ -128,7 +552,15 @@ func (s *Server) AcceptTCP(listener net.Listener) {
 			return
 		}
 
-		go s.HandleTCPConn(conn)
+		// check the limits before spawning a goroutine for the connection
+		err = s.trackConn(conn)
+		if err != nil {
+			s.logger.Warn("connection rejected", zap.String("mode", string(mode)), zap.String("remote", conn.RemoteAddr().String()), zap.String("reason", err.Error()))
+			conn.Close()
+			continue
+		}
+
+		go s.HandleTCPConn(mode, handler, conn)
 	}
 }
 
@@ -136,46 +568,103 @@ type ContextKey string
 
 var reqIDContextKey ContextKey = "req-id"
 
-func (s *Server) HandleTCPConn(conn net.Conn) {
-	ctx := context.Background()
+// HandleTCPConn serves a connection already registered with trackConn
+func (s *Server) HandleTCPConn(mode ProtoHackersMode, handler Handler, conn net.Conn) {
+	defer s.untrackConn(conn)
+
+	s.metrics.activeConns.Inc(string(mode))
+	defer s.metrics.activeConns.Dec(string(mode))
+
+	start := time.Now()
 	reqID := uuid.New().String()
-	ctx = context.WithValue(ctx, reqIDContextKey, reqID)
-
-	s.logger.Info("received connection", zap.String("reqID", reqID), zap.String("remote", conn.RemoteAddr().String()))
-
-	switch s.mode {
-	case ProtoHackersModeEcho:
-		s.HandleEcho(ctx, conn)
-	case ProtoHackersModePrimeTime:
-		s.HandlePrimeTime(ctx, conn)
-	case ProtoHackersModeMeans:
-		s.HandleMeans(ctx, conn)
-	case ProtoHackersModeBudgetChat:
-		s.HandleBudgetChat(ctx, conn)
-	case ProtoHackersModeMobInTheMiddle:
-		s.HandleMobInTheMiddle(ctx, conn)
-	case ProtoHackersModeSpeedDaemon:
-		s.HandleSpeedDaemon(ctx, conn)
-	default:
-		panic("invalid mode: " + s.mode)
-	}
+	stats := newConnStats()
+	ctx := context.WithValue(s.ctx, reqIDContextKey, reqID)
+	ctx = context.WithValue(ctx, connStatsContextKey, stats)
+
+	s.logger.Info("received connection", zap.String("reqID", reqID), zap.String("mode", string(mode)), zap.String("remote", conn.RemoteAddr().String()))
 
-	s.logger.Info("ended connection", zap.String("reqID", reqID), zap.String("remote", conn.RemoteAddr().String()))
+	handlerDone := make(chan bool)
+	defer close(handlerDone)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock the handler reads so that it can notice the cancellation and end the connection cleanly
+			conn.SetReadDeadline(time.Now())
+		case <-handlerDone:
+		}
+	}()
+
+	handler.Serve(ctx, &countingConn{
+		Conn:    s.wrapConn(ctx, conn),
+		mode:    mode,
+		metrics: s.metrics,
+		stats:   stats,
+	})
+
+	s.logAccess(reqID, mode, conn.RemoteAddr(), start, stats)
 }
 
-func (s *Server) StartUnusualDatabase(done <-chan bool) error {
-	udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: s.port})
+func (s *Server) StartUDP(l Listener, handler Handler) (io.Closer, error) {
+	addr := net.JoinHostPort(s.bindAddress, strconv.Itoa(l.Port))
+	udpConn, err := net.ListenUDP(s.network(TransportUDP), &net.UDPAddr{IP: net.ParseIP(s.bindAddress), Port: l.Port})
 	if err != nil {
-		return errors.Wrapf(err, "failed to start udp listener")
+		return nil, errors.Wrapf(err, "failed to start udp listener")
 	}
 
-	s.logger.Sugar().Infof("UDP Server listening on %d / mode: %s ...", s.port, s.mode)
+	s.logger.Sugar().Infof("UDP Server listening on %s / mode: %s ...", addr, l.Mode)
 
-	go s.HandleUnusualDatabase(udpConn)
+	var conn net.Conn = udpConn
+	if s.udpRate > 0 {
+		conn = &rateLimitedUDPConn{
+			UDPConn: udpConn,
+			limiter: newUDPRateLimiter(s.udpRate, s.udpBurst),
+			onDrop: func(addr net.Addr) {
+				s.datagramDropped(l.Mode, addr, udpDropRateLimit)
+			},
+		}
+	}
 
-	<-done
-	s.logger.Sugar().Infof("UDP: Received 'done' signal, closing listener")
-	udpConn.Close()
+	go handler.Serve(s.ctx, conn)
+
+	return udpConn, nil
+}
+
+// network returns the go network name of transport for the server address family, e.g. tcp4
+func (s *Server) network(transport Transport) string {
+	switch s.addressFamily {
+	case AddressFamilyIPv6:
+		return string(transport) + "6"
+	case AddressFamilyDualStack:
+		return string(transport)
+	default:
+		return string(transport) + "4"
+	}
+}
+
+func validateBindAddress(bindAddress string, addressFamily AddressFamily) error {
+	switch addressFamily {
+	case AddressFamilyIPv4, AddressFamilyIPv6, AddressFamilyDualStack:
+	default:
+		return fmt.Errorf("invalid address family %s", addressFamily)
+	}
+
+	if bindAddress == "" {
+		return nil
+	}
+
+	ip := net.ParseIP(bindAddress)
+	if ip == nil {
+		return fmt.Errorf("invalid bind address %s", bindAddress)
+	}
+
+	isIPv4 := ip.To4() != nil
+	if addressFamily == AddressFamilyIPv4 && !isIPv4 {
+		return fmt.Errorf("bind address %s is not an ipv4 address", bindAddress)
+	}
+	if addressFamily == AddressFamilyIPv6 && isIPv4 {
+		return fmt.Errorf("bind address %s is not an ipv6 address", bindAddress)
+	}
 
 	return nil
 }
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/didil/protohackers/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := ParseListeners("echo:3000, prime:3001,ud:3000")
+	assert.NoError(t, err)
+	assert.Equal(t, []Listener{
+		{Mode: ProtoHackersModeEcho, Port: 3000},
+		{Mode: ProtoHackersModePrimeTime, Port: 3001},
+		{Mode: ProtoHackersModeUnusualDatabase, Port: 3000},
+	}, listeners)
+
+	_, err = ParseListeners("echo")
+	assert.ErrorContains(t, err, `invalid binding "echo", expected mode:port`)
+
+	_, err = ParseListeners("echo:abc")
+	assert.ErrorContains(t, err, `invalid port in binding "echo:abc"`)
+
+	_, err = ParseListeners("echo:70000")
+	assert.ErrorContains(t, err, `invalid port in binding "echo:70000"`)
+}
+
+func TestNewMultiServerInvalid(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	_, err = NewMultiServer([]Listener{}, logger)
+	assert.ErrorContains(t, err, "no listener")
+
+	_, err = NewMultiServer([]Listener{{Mode: "chess", Port: 3000}}, logger)
+	assert.ErrorContains(t, err, "invalid mode chess")
+
+	_, err = NewMultiServer([]Listener{
+		{Mode: ProtoHackersModeEcho, Port: 3000},
+		{Mode: ProtoHackersModePrimeTime, Port: 3000},
+	}, logger)
+	assert.ErrorContains(t, err, "port tcp/3000 used by several modes")
+
+	// tcp and udp can share a port number
+	_, err = NewMultiServer([]Listener{
+		{Mode: ProtoHackersModeEcho, Port: 3000},
+		{Mode: ProtoHackersModeUnusualDatabase, Port: 3000},
+	}, logger)
+	assert.NoError(t, err)
+}
+
+func TestMultiServer(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	s, err := NewMultiServer([]Listener{
+		{Mode: ProtoHackersModeEcho, Port: 35000},
+		{Mode: ProtoHackersModePrimeTime, Port: 35001},
+		{Mode: ProtoHackersModeUnusualDatabase, Port: 35000},
+	}, logger, WithUnusualDbService(services.NewUnusualDbService()))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// echo
+	echoConn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.NoError(t, err)
+	defer echoConn.Close()
+
+	_, err = echoConn.Write([]byte("ABC"))
+	assert.NoError(t, err)
+	assert.NoError(t, echoConn.CloseWrite())
+
+	readData, err := io.ReadAll(echoConn)
+	assert.NoError(t, err)
+	assert.Equal(t, "ABC", string(readData))
+
+	// prime
+	primeConn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35001})
+	assert.NoError(t, err)
+	defer primeConn.Close()
+
+	_, err = primeConn.Write([]byte("{\"method\":\"isPrime\",\"number\":3}\n"))
+	assert.NoError(t, err)
+
+	sc := bufio.NewScanner(primeConn)
+	assert.True(t, sc.Scan())
+	assert.Equal(t, "{\"method\":\"isPrime\",\"prime\":true}", sc.Text())
+
+	// unusual database
+	udpConn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.NoError(t, err)
+	defer udpConn.Close()
+
+	_, err = udpConn.Write([]byte("version"))
+	assert.NoError(t, err)
+
+	udpConn.SetReadDeadline(time.Now().Add(time.Second))
+	outputData := make([]byte, DefaultUDMaxContentSize)
+	n, err := udpConn.Read(outputData)
+	assert.NoError(t, err)
+	assert.Equal(t, "version=Ken's Key-Value Store 1.0", string(outputData[:n]))
+
+	// all listeners stop together
+	done <- true
+	<-stopped
+
+	_, err = net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.Error(t, err)
+	_, err = net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35001})
+	assert.Error(t, err)
+
+	// the udp port can be bound again
+	udpListener, err := net.ListenUDP("udp4", &net.UDPAddr{Port: 35000})
+	assert.NoError(t, err)
+	udpListener.Close()
+}
+
+func TestMultiServerListenError(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	busy, err := net.Listen("tcp4", ":35001")
+	assert.NoError(t, err)
+	defer busy.Close()
+
+	s, err := NewMultiServer([]Listener{
+		{Mode: ProtoHackersModeEcho, Port: 35000},
+		{Mode: ProtoHackersModePrimeTime, Port: 35001},
+	}, logger)
+	assert.NoError(t, err)
+
+	err = s.Start(make(chan bool))
+	assert.ErrorContains(t, err, "failed to start listener")
+
+	// listeners opened before the error are closed
+	l, err := net.Listen("tcp4", ":35000")
+	assert.NoError(t, err)
+	l.Close()
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	s, err := NewServer(ProtoHackersModeEcho, 35000, logger, WithDrainTimeout(2*time.Second))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ABC"))
+	assert.NoError(t, err)
+
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, s.ActiveConnections())
+
+	start := time.Now()
+	done <- true
+	<-stopped
+
+	// the handler noticed the cancellation, no need to wait for the drain timeout
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, 0, s.ActiveConnections())
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(buf)
+	assert.Equal(t, io.EOF, err)
+
+	summary := logs.FilterMessage("shutdown complete").All()
+	assert.Len(t, summary, 1)
+	assert.Equal(t, int64(1), summary[0].ContextMap()["activeConnections"])
+	assert.Equal(t, int64(1), summary[0].ContextMap()["drained"])
+	assert.Equal(t, int64(0), summary[0].ContextMap()["forciblyClosed"])
+}
+
+func TestShutdownForcesStuckConnections(t *testing.T) {
+	mode := ProtoHackersMode("test-stuck")
+	exited := &atomic.Int32{}
+	RegisterMode(mode, TransportTCP, func(s *Server) (Handler, error) {
+		return HandlerFunc(func(ctx context.Context, conn net.Conn) {
+			// ignores cancellation, only returns once the conn is closed
+			for {
+				_, err := conn.Write([]byte("."))
+				if errors.Is(err, net.ErrClosed) {
+					// still busy for a while once the conn is closed, e.g. saving its state
+					time.Sleep(100 * time.Millisecond)
+					exited.Add(1)
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}), nil
+	})
+	t.Cleanup(func() { unregisterMode(mode) })
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	s, err := NewServer(string(mode), 35000, logger, WithDrainTimeout(300*time.Millisecond))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conns := []net.Conn{}
+	for i := 0; i < 2; i++ {
+		conn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+		assert.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, s.ActiveConnections())
+
+	start := time.Now()
+	done <- true
+	<-stopped
+
+	assert.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+	// the handlers are done when Start returns
+	assert.Equal(t, int32(2), exited.Load())
+
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		// the dots written until the conn was closed, then EOF
+		_, err = io.ReadAll(conn)
+		assert.NoError(t, err)
+	}
+
+	summary := logs.FilterMessage("shutdown complete").All()
+	assert.Len(t, summary, 1)
+	assert.Equal(t, int64(2), summary[0].ContextMap()["activeConnections"])
+	assert.Equal(t, int64(0), summary[0].ContextMap()["drained"])
+	assert.Equal(t, int64(2), summary[0].ContextMap()["forciblyClosed"])
+}
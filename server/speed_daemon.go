@@ -1,279 +1,270 @@
 package server
 
 import (
+	"bufio"
 	"context"
-	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/didil/protohackers/services"
+	"github.com/didil/protohackers/speeddaemon/proto"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
-func (s *Server) HandleSpeedDaemon(ctx context.Context, conn net.Conn) {
-	defer conn.Close()
-
-	reqID, _ := ctx.Value(reqIDContextKey).(string)
-
-	connDone := make(chan bool, 1)
-
-	for {
-		err := s.processClientMsg(reqID, conn, connDone)
-		if err != nil {
-			s.speedDaemonSvc.UnregisterClient(reqID)
-			if err == io.EOF {
-				break
-			}
-			s.sendError(conn, err)
-			break
-		}
-	}
+const ProtoHackersModeSpeedDaemon = "speed-daemon"
 
-	connDone <- true
+func init() {
+	RegisterMode(ProtoHackersModeSpeedDaemon, TransportTCP, func(s *Server) (Handler, error) {
+		return HandlerFunc(s.HandleSpeedDaemon), nil
+	})
 }
 
-func (s *Server) processClientMsg(reqID string, conn net.Conn, connDone chan bool) error {
-	msgTypeData := make([]byte, 1)
-	_, err := conn.Read(msgTypeData)
-	if err != nil {
-		return err
-	}
+type speedDaemonClientState int
 
-	msgType, err := parseClientMessageType(msgTypeData)
-	if err != nil {
-		return err
+const (
+	speedDaemonClientUnidentified speedDaemonClientState = iota
+	speedDaemonClientCamera
+	speedDaemonClientDispatcher
+)
+
+func (state speedDaemonClientState) String() string {
+	switch state {
+	case speedDaemonClientCamera:
+		return "camera"
+	case speedDaemonClientDispatcher:
+		return "dispatcher"
+	default:
+		return "unidentified client"
 	}
+}
 
+// nextSpeedDaemonClientState returns the state of the client after it sent a message of type msgType,
+// or an error if the client is not allowed to send that message
+func nextSpeedDaemonClientState(state speedDaemonClientState, msgType proto.MsgType) (speedDaemonClientState, error) {
 	switch msgType {
-	case MsgTypeIAmCamera:
-		iAmCamera, err := parseIAmCamera(conn)
-		if err != nil {
-			return err
-		}
-
-		err = s.speedDaemonSvc.RegisterAsCamera(reqID, int(iAmCamera.road), int(iAmCamera.mile), int(iAmCamera.limit))
-		if err != nil {
-			return err
-		}
-	case MsgTypeIAmDispatcher:
-		iAmDispatcher, err := parseIAmDispatcher(conn)
-		if err != nil {
-			return err
-		}
-
-		ticketChannels, err := s.speedDaemonSvc.RegisterAsDispatcher(reqID, iAmDispatcher.roads)
-		if err != nil {
-			return err
-		}
-
-		for i := 0; i < len(ticketChannels); i++ {
-			ticketC := ticketChannels[i]
-			go func() {
-				select {
-				case <-connDone:
-					return
-				case t := <-ticketC:
-					s.sendTicket(conn, t)
-					if err != nil {
-						s.logger.Error("failed to write to conn", zap.Error(err))
-						return
-					}
-				}
-			}()
+	case proto.MsgTypeIAmCamera:
+		if state != speedDaemonClientUnidentified {
+			return state, fmt.Errorf("illegal msg: IAmCamera from a client already identified as %s", state)
 		}
-
-	case MsgTypePlate:
-		camera, err := s.speedDaemonSvc.GetCamera(reqID)
-		if err != nil {
-			// not registered as camera
-			return err
+		return speedDaemonClientCamera, nil
+	case proto.MsgTypeIAmDispatcher:
+		if state != speedDaemonClientUnidentified {
+			return state, fmt.Errorf("illegal msg: IAmDispatcher from a client already identified as %s", state)
 		}
-
-		plate, err := parsePlate(conn)
-		if err != nil {
-			return err
+		return speedDaemonClientDispatcher, nil
+	case proto.MsgTypePlate:
+		if state != speedDaemonClientCamera {
+			return state, fmt.Errorf("illegal msg: Plate from %s, only cameras can send plates", state)
 		}
+		return state, nil
+	case proto.MsgTypeWantHeartbeat:
+		return state, nil
+	default:
+		return state, fmt.Errorf("illegal msg: %s is a server message", msgType)
+	}
+}
 
-		s.speedDaemonSvc.SavePlateObservation(plate.plate, plate.timestamp, camera.Road, camera.Mile, camera.Limit)
+type speedDaemonConn struct {
+	reqID string
+	// stats collects the connection access log figures
+	stats *connStats
+	state speedDaemonClientState
+	r     *bufio.Reader
+	w     *bufio.Writer
+	// writeLock serializes writes coming from the ticket and heartbeat goroutines
+	writeLock *sync.Mutex
+	// done is closed when the connection ends
+	done               chan bool
+	heartbeatRequested bool
+}
 
+func newSpeedDaemonConn(reqID string, stats *connStats, conn net.Conn) *speedDaemonConn {
+	return &speedDaemonConn{
+		reqID:     reqID,
+		stats:     stats,
+		r:         bufio.NewReader(conn),
+		w:         bufio.NewWriter(conn),
+		writeLock: &sync.Mutex{},
+		done:      make(chan bool),
 	}
-
-	return nil
 }
 
-func (s *Server) sendError(conn net.Conn, err error) {
-	msg := err.Error()
-	bufLen := 1 + 1 + len(msg) // 1 byte to store msg type + 1 byte to store str length
-	buf := make([]byte, bufLen)
-	buf[0] = byte(MsgTypeServerError)
-	writeStringToBuf(buf, 1, msg)
+// send writes a whole message to the connection
+func (c *speedDaemonConn) send(m proto.Message) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
 
-	_, err = conn.Write(buf)
+	err := m.Encode(c.w)
 	if err != nil {
-		s.logger.Error("failed to write to conn", zap.Error(err))
+		return err
 	}
-}
-
-func writeStringToBuf(buf []byte, i int, msg string) {
-	buf[i] = byte(len(msg))
-	copy(buf[i+1:], []byte(msg))
-}
 
-func (s *Server) sendTicket(conn net.Conn, t *services.Ticket) error {
-	// 1 byte to store msg type
-	// 1 byte to store platenumber str length
-	// n bytes for platenumber
-	// 2 bytes for road
-	// 2 bytes for mile1
-	// 4 bytes for timestamp1
-	// 2 bytes for mile2
-	// 4 bytes for timestamp2
-	// 2 bytes for speed
-
-	bufLen := 1 + 1 + len(t.Plate) + 2 + 2 + 4 + 2 + 4 + 2
-	buf := make([]byte, bufLen)
-	buf[0] = byte(MsgTypeTicket)
-	writeStringToBuf(buf, 1, t.Plate)
-
-	_, err := conn.Write(buf)
+	err = c.w.Flush()
 	if err != nil {
 		return errors.Wrapf(err, "failed to write to conn")
 	}
 
-	// write missing fields
+	c.stats.messageOut()
 
 	return nil
 }
 
-type MsgType byte
-
-const (
-	// Server Messages
-	MsgTypeServerError MsgType = 0x10
-	MsgTypeTicket      MsgType = 0x21
-	MsgTypeHeartbeat   MsgType = 0x41
-
-	// Client Messages
-	MsgTypePlate         MsgType = 0x20
-	MsgTypeWantHeartbeat MsgType = 0x40
-	MsgTypeIAmCamera     MsgType = 0x80
-	MsgTypeIAmDispatcher MsgType = 0x81
-)
+func (s *Server) HandleSpeedDaemon(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
 
-func parseClientMessageType(msgTypeData []byte) (MsgType, error) {
-	switch msgTypeData[0] {
-	case byte(MsgTypePlate):
-		return MsgTypePlate, nil
-	case byte(MsgTypeWantHeartbeat):
-		return MsgTypeWantHeartbeat, nil
-	case byte(MsgTypeIAmCamera):
-		return MsgTypeIAmCamera, nil
-	case byte(MsgTypeIAmDispatcher):
-		return MsgTypeIAmDispatcher, nil
+	reqID, _ := ctx.Value(reqIDContextKey).(string)
 
-	default:
-		return 0, errors.New("illegal msg")
-	}
-}
+	c := newSpeedDaemonConn(reqID, connStatsFromContext(ctx), conn)
 
-type IAmCamera struct {
-	road  int
-	mile  int
-	limit int
-}
+	for ctx.Err() == nil {
+		err := s.processClientMsg(c)
+		if err == nil {
+			continue
+		}
 
-func parseIAmCamera(r io.Reader) (*IAmCamera, error) {
-	buf := make([]byte, 6) // 2 + 2 + 2
-	_, err := io.ReadFull(r, buf)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return nil, errors.New("message IAmCamera incomplete")
+		// no error message when the client left or the server is shutting down
+		if err != io.EOF && ctx.Err() == nil {
+			s.metrics.handlerErrors.Inc(ProtoHackersModeSpeedDaemon)
+			c.stats.setCloseReason(err.Error())
+			s.sendError(c, err)
+		}
+		break
 	}
 
-	iAmCamera := &IAmCamera{}
-	iAmCamera.road = int(binary.BigEndian.Uint16(buf[0:2]))
-	iAmCamera.mile = int(binary.BigEndian.Uint16(buf[2:4]))
-	iAmCamera.limit = int(binary.BigEndian.Uint16(buf[4:6]))
-
-	return iAmCamera, nil
-}
+	s.speedDaemonSvc.UnregisterClient(reqID)
 
-type IAmDispatcher struct {
-	numRoads int
-	roads    []int
+	// stops ticket and heartbeat goroutines
+	close(c.done)
 }
 
-func parseIAmDispatcher(r io.Reader) (*IAmDispatcher, error) {
-	numRoadsBuf := make([]byte, 1)
-	_, err := io.ReadFull(r, numRoadsBuf)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return nil, errors.New("message IAmDispatcher incomplete")
+func (s *Server) processClientMsg(c *speedDaemonConn) error {
+	msg, err := proto.Decode(c.r)
+	if err != nil {
+		return err
 	}
+	c.stats.messageIn()
 
-	iAmDispatcher := &IAmDispatcher{}
-	iAmDispatcher.numRoads = int(numRoadsBuf[0])
-
-	roadsBuf := make([]byte, iAmDispatcher.numRoads*2)
-	_, err = io.ReadFull(r, roadsBuf)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return nil, errors.New("message IAmDispatcher incomplete")
+	c.state, err = nextSpeedDaemonClientState(c.state, msg.Type())
+	if err != nil {
+		return err
 	}
 
-	iAmDispatcher.roads = make([]int, iAmDispatcher.numRoads)
+	switch m := msg.(type) {
+	case *proto.IAmCamera:
+		err = s.speedDaemonSvc.RegisterAsCamera(c.reqID, int(m.Road), int(m.Mile), int(m.Limit))
+		if err != nil {
+			return err
+		}
+	case *proto.IAmDispatcher:
+		roads := make([]int, 0, len(m.Roads))
+		for _, road := range m.Roads {
+			roads = append(roads, int(road))
+		}
 
-	for i := 0; i < iAmDispatcher.numRoads; i++ {
-		iAmDispatcher.roads[i] = int(binary.BigEndian.Uint16(roadsBuf[2*i : 2*i+2]))
-	}
+		ticketsReady, err := s.speedDaemonSvc.RegisterAsDispatcher(c.reqID, roads)
+		if err != nil {
+			return err
+		}
 
-	return iAmDispatcher, nil
-}
+		go s.sendTickets(c, ticketsReady)
 
-type Plate struct {
-	plate     string
-	timestamp int
-}
+	case *proto.Plate:
+		camera, err := s.speedDaemonSvc.GetCamera(c.reqID)
+		if err != nil {
+			// not registered as camera
+			return err
+		}
 
-func parsePlate(r io.Reader) (*Plate, error) {
-	plateLengthBuf := make([]byte, 1)
-	_, err := io.ReadFull(r, plateLengthBuf)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return nil, errors.New("message Plate incomplete")
-	}
+		s.speedDaemonSvc.SavePlateObservation(m.Plate, int(m.Timestamp), camera.Road, camera.Mile, camera.Limit)
 
-	plateBuf := make([]byte, int(plateLengthBuf[0]))
-	_, err = io.ReadFull(r, plateBuf)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return nil, errors.New("message Plate incomplete")
-	}
+	case *proto.WantHeartbeat:
+		if c.heartbeatRequested {
+			return errors.New("heartbeat already requested")
+		}
+		c.heartbeatRequested = true
 
-	plate := &Plate{}
-	plate.plate = string(plateBuf)
+		if m.Interval > 0 {
+			go s.sendHeartbeats(c, int(m.Interval))
+		}
 
-	timestampBuf := make([]byte, 4)
-	_, err = io.ReadFull(r, timestampBuf)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return nil, errors.New("message Plate incomplete")
+	default:
+		return errors.New("illegal msg")
 	}
 
-	plate.timestamp = int(binary.BigEndian.Uint32(timestampBuf))
+	return nil
+}
 
-	return plate, nil
+// sendTickets writes the tickets routed to the dispatcher until the connection ends
+func (s *Server) sendTickets(c *speedDaemonConn, ticketsReady chan bool) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticketsReady:
+			for t := s.speedDaemonSvc.NextTicket(c.reqID); t != nil; t = s.speedDaemonSvc.NextTicket(c.reqID) {
+				err := s.sendTicket(c, t)
+				if err != nil {
+					s.handlerError(ProtoHackersModeSpeedDaemon, "failed to write to conn", zap.Error(err))
+					// take the dispatcher out of the road rotation first, so that its queued tickets
+					// and this one go to the other dispatchers
+					s.speedDaemonSvc.UnregisterClient(c.reqID)
+					s.speedDaemonSvc.RequeueTicket(t)
+					return
+				}
+				s.speedDaemonSvc.MarkTicketSent(t)
+				s.metrics.ticketsDelivered.Inc()
+			}
+		}
+	}
 }
 
-type WantHeartbeat struct {
-	interval int
+// sendHeartbeats writes a Heartbeat message every interval deciseconds until the connection ends
+func (s *Server) sendHeartbeats(c *speedDaemonConn, interval int) {
+	ticker := time.NewTicker(time.Duration(interval) * 100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			err := s.sendHeartbeat(c)
+			if err != nil {
+				s.handlerError(ProtoHackersModeSpeedDaemon, "failed to write to conn", zap.Error(err))
+				return
+			}
+		}
+	}
 }
 
-func parseWantHeartbeat(r io.Reader) (*WantHeartbeat, error) {
-	wantHeartbeat := &WantHeartbeat{}
+func (s *Server) sendError(c *speedDaemonConn, err error) {
+	msg := err.Error()
+	if len(msg) > 255 {
+		msg = msg[:255]
+	}
 
-	intervalBuf := make([]byte, 4)
-	_, err := io.ReadFull(r, intervalBuf)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return nil, errors.New("message Plate incomplete")
+	err = c.send(&proto.Error{Msg: msg})
+	if err != nil {
+		s.handlerError(ProtoHackersModeSpeedDaemon, "failed to write to conn", zap.Error(err))
 	}
+}
 
-	wantHeartbeat.interval = int(binary.BigEndian.Uint32(intervalBuf))
+func (s *Server) sendTicket(c *speedDaemonConn, t *services.Ticket) error {
+	return c.send(&proto.Ticket{
+		Plate:      t.Plate,
+		Road:       uint16(t.Road),
+		Mile1:      uint16(t.Mile1),
+		Timestamp1: uint32(t.Timestamp1),
+		Mile2:      uint16(t.Mile2),
+		Timestamp2: uint32(t.Timestamp2),
+		Speed:      uint16(t.Speed),
+	})
+}
 
-	return wantHeartbeat, nil
+func (s *Server) sendHeartbeat(c *speedDaemonConn) error {
+	return c.send(&proto.Heartbeat{})
 }
@@ -1,151 +1,465 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/didil/protohackers/services"
+	"github.com/didil/protohackers/speeddaemon/proto"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 )
 
-func TestParseClientMessageType(t *testing.T) {
-	msgType, err := parseClientMessageType([]byte{byte(MsgTypeIAmCamera)})
-
+func TestSendTicket(t *testing.T) {
+	logger, err := zap.NewDevelopment()
 	assert.NoError(t, err)
-	assert.Equal(t, MsgTypeIAmCamera, msgType)
 
-	msgType, err = parseClientMessageType([]byte{byte(MsgTypePlate)})
+	s, err := NewServer(ProtoHackersModeSpeedDaemon, 35000, logger)
+	assert.NoError(t, err)
 
+	ticket := &services.Ticket{
+		Plate:      "UN1X",
+		Road:       66,
+		Mile1:      100,
+		Timestamp1: 123456,
+		Mile2:      110,
+		Timestamp2: 123816,
+		Speed:      10000,
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.sendTicket(newBufferedSpeedDaemonConn(buf), ticket)
 	assert.NoError(t, err)
-	assert.Equal(t, MsgTypePlate, msgType)
 
-	msgType, err = parseClientMessageType([]byte{byte(MsgTypeWantHeartbeat)})
+	assert.Equal(t, "2104554e3158004200640001e240006e0001e3a82710", hex.EncodeToString(buf.Bytes()))
 
+	decoded, err := decodeTicket(buf)
 	assert.NoError(t, err)
-	assert.Equal(t, MsgTypeWantHeartbeat, msgType)
+	assert.Equal(t, ticket, decoded)
+	assert.Equal(t, 0, buf.Len())
+}
 
-	msgType, err = parseClientMessageType([]byte{byte(MsgTypeIAmDispatcher)})
+func TestSendTicket2(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
 
+	s, err := NewServer(ProtoHackersModeSpeedDaemon, 35000, logger)
 	assert.NoError(t, err)
-	assert.Equal(t, MsgTypeIAmDispatcher, msgType)
 
-	_, err = parseClientMessageType([]byte{byte(MsgTypeServerError)})
-	assert.ErrorContains(t, err, "illegal msg")
+	ticket := &services.Ticket{
+		Plate:      "RE05BKG",
+		Road:       368,
+		Mile1:      1234,
+		Timestamp1: 1000000,
+		Mile2:      1235,
+		Timestamp2: 1000060,
+		Speed:      6000,
+	}
+
+	buf := &bytes.Buffer{}
+	err = s.sendTicket(newBufferedSpeedDaemonConn(buf), ticket)
+	assert.NoError(t, err)
 
-	_, err = parseClientMessageType([]byte{byte(MsgTypeServerError)})
-	assert.ErrorContains(t, err, "illegal msg")
+	assert.Equal(t, "210752453035424b47017004d2000f424004d3000f427c1770", hex.EncodeToString(buf.Bytes()))
 
-	_, err = parseClientMessageType([]byte{byte(MsgTypeHeartbeat)})
-	assert.ErrorContains(t, err, "illegal msg")
+	decoded, err := decodeTicket(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, ticket, decoded)
 }
 
-func TestWriteStringToBuf(t *testing.T) {
-	msg1 := "foo"
-	buf1 := make([]byte, 1+len(msg1))
-	writeStringToBuf(buf1, 0, msg1)
+// decodeTicket reads a Ticket message the way a dispatcher client would
+func decodeTicket(r io.Reader) (*services.Ticket, error) {
+	msg, err := proto.Decode(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := msg.(*proto.Ticket)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message %s", msg.Type())
+	}
+
+	return &services.Ticket{
+		Plate:      t.Plate,
+		Road:       int(t.Road),
+		Mile1:      int(t.Mile1),
+		Timestamp1: int(t.Timestamp1),
+		Mile2:      int(t.Mile2),
+		Timestamp2: int(t.Timestamp2),
+		Speed:      int(t.Speed),
+	}, nil
+}
 
-	assert.Equal(t, "03666f6f", hex.EncodeToString(buf1))
+// newBufferedSpeedDaemonConn returns a conn writing its messages to buf
+func newBufferedSpeedDaemonConn(buf *bytes.Buffer) *speedDaemonConn {
+	c := newSpeedDaemonConn("", nil, nil)
+	c.w = bufio.NewWriter(buf)
 
-	msg2 := "Elbereth"
-	buf2 := make([]byte, 1+len(msg1)+1+len(msg2))
-	copy(buf2, buf1)
-	writeStringToBuf(buf2, 1+len(msg1), msg2)
+	return c
+}
 
-	assert.Equal(t, "03666f6f08456c626572657468", hex.EncodeToString(buf2))
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
 }
 
-func TestParseIAmCamera(t *testing.T) {
-	buf, err := hex.DecodeString("00420064003c")
+func TestSendTicketsWriteError(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	store := &recordingSpeedDaemonStore{}
+	speedDaemonSvc := services.NewSpeedDaemonService(services.WithSpeedDaemonStore(store))
+
+	s, err := NewServer(ProtoHackersModeSpeedDaemon, 35000, logger, WithSpeedDaemonDbService(speedDaemonSvc))
 	assert.NoError(t, err)
 
-	r := bytes.NewReader(buf)
-	iAmCamera, err := parseIAmCamera(r)
+	deadReady, err := speedDaemonSvc.RegisterAsDispatcher("dead", []int{66})
 	assert.NoError(t, err)
+	_, err = speedDaemonSvc.RegisterAsDispatcher("alive", []int{66})
+	assert.NoError(t, err)
+
+	// 3 tickets, routed in turn to the dispatchers
+	for _, plate := range []string{"P1", "P2", "P3"} {
+		speedDaemonSvc.SavePlateObservation(plate, 0, 66, 0, 60)
+		speedDaemonSvc.SavePlateObservation(plate, 60, 66, 2, 60)
+	}
+
+	c := newSpeedDaemonConn("dead", nil, nil)
+	c.w = bufio.NewWriter(failingWriter{})
 
-	assert.Equal(t, 66, int(iAmCamera.road))
-	assert.Equal(t, 100, int(iAmCamera.mile))
-	assert.Equal(t, 60, int(iAmCamera.limit))
+	s.sendTickets(c, deadReady)
+
+	assert.Equal(t, []string{"alive"}, speedDaemonSvc.GetReqIdsForRoad(66))
+
+	plates := []string{}
+	for ticket := speedDaemonSvc.NextTicket("alive"); ticket != nil; ticket = speedDaemonSvc.NextTicket("alive") {
+		plates = append(plates, ticket.Plate)
+	}
+	assert.ElementsMatch(t, []string{"P1", "P2", "P3"}, plates)
+
+	// the ticket that failed to be written is not recorded as sent
+	for _, r := range store.records {
+		assert.NotEqual(t, services.SpeedDaemonRecordTicketSent, r.Type)
+	}
+}
+
+// recordingSpeedDaemonStore keeps the appended records in memory
+type recordingSpeedDaemonStore struct {
+	records []*services.SpeedDaemonRecord
+}
+
+func (st *recordingSpeedDaemonStore) Records() []*services.SpeedDaemonRecord { return nil }
+func (st *recordingSpeedDaemonStore) Append(r *services.SpeedDaemonRecord) error {
+	st.records = append(st.records, r)
+	return nil
 }
+func (st *recordingSpeedDaemonStore) Close() error { return nil }
 
-func TestParseIAmCamera2(t *testing.T) {
-	buf, err := hex.DecodeString("017004d20028")
+func TestHandleSpeedDaemonHeartbeat(t *testing.T) {
+	mode := ProtoHackersModeSpeedDaemon
+	port := 35000
+	logger, err := zap.NewDevelopment()
 	assert.NoError(t, err)
 
-	r := bytes.NewReader(buf)
-	iAmCamera, err := parseIAmCamera(r)
+	s, err := NewServer(mode, port, logger, WithSpeedDaemonDbService(services.NewSpeedDaemonService()))
 	assert.NoError(t, err)
 
-	assert.Equal(t, 368, int(iAmCamera.road))
-	assert.Equal(t, 1234, int(iAmCamera.mile))
-	assert.Equal(t, 40, int(iAmCamera.limit))
-}
+	done := make(chan bool, 1)
 
-func TestParseIAmDispatcher(t *testing.T) {
-	buf, err := hex.DecodeString("010042")
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	tcpAddr := &net.TCPAddr{
+		IP:   net.ParseIP("127.0.0.1"),
+		Port: port,
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTCP("tcp4", nil, tcpAddr)
 	assert.NoError(t, err)
+	defer conn.Close()
+
+	// WantHeartbeat every 1 decisecond
+	writeHex(t, "4000000001", conn)
 
-	r := bytes.NewReader(buf)
-	iAmDispatcher, err := parseIAmDispatcher(r)
+	buf := make([]byte, 1)
+	for i := 0; i < 3; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(conn, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, byte(proto.MsgTypeHeartbeat), buf[0])
+	}
+
+	// a second WantHeartbeat is an error
+	writeHex(t, "4000000001", conn)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := io.ReadAll(conn)
 	assert.NoError(t, err)
 
-	assert.Equal(t, 1, iAmDispatcher.numRoads)
-	assert.Equal(t, []int{66}, iAmDispatcher.roads)
+	errMsg := "heartbeat already requested"
+	expected := append([]byte{byte(proto.MsgTypeError), byte(len(errMsg))}, []byte(errMsg)...)
+	assert.True(t, bytes.HasSuffix(data, expected))
+	// only heartbeats may precede the error
+	assert.Equal(t, bytes.Repeat([]byte{byte(proto.MsgTypeHeartbeat)}, len(data)-len(expected)), data[:len(data)-len(expected)])
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
 }
 
-func TestParseIAmDispatcher2(t *testing.T) {
-	buf, err := hex.DecodeString("03004201701388")
+func TestHandleSpeedDaemonHeartbeatDisabled(t *testing.T) {
+	mode := ProtoHackersModeSpeedDaemon
+	port := 35000
+	logger, err := zap.NewDevelopment()
 	assert.NoError(t, err)
 
-	r := bytes.NewReader(buf)
-	iAmDispatcher, err := parseIAmDispatcher(r)
+	s, err := NewServer(mode, port, logger, WithSpeedDaemonDbService(services.NewSpeedDaemonService()))
 	assert.NoError(t, err)
 
-	assert.Equal(t, 3, iAmDispatcher.numRoads)
-	assert.Equal(t, []int{66, 368, 5000}, iAmDispatcher.roads)
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	tcpAddr := &net.TCPAddr{
+		IP:   net.ParseIP("127.0.0.1"),
+		Port: port,
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialTCP("tcp4", nil, tcpAddr)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// interval 0 means no heartbeats
+	writeHex(t, "4000000000", conn)
+
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
 }
 
-func TestParsePlate(t *testing.T) {
-	buf, err := hex.DecodeString("04554e3158000003e8")
+func TestSendHeartbeat(t *testing.T) {
+	logger, err := zap.NewDevelopment()
 	assert.NoError(t, err)
 
-	r := bytes.NewReader(buf)
-	plate, err := parsePlate(r)
+	s, err := NewServer(ProtoHackersModeSpeedDaemon, 35000, logger)
 	assert.NoError(t, err)
 
-	assert.Equal(t, "UN1X", plate.plate)
-	assert.Equal(t, 1000, plate.timestamp)
+	buf := &bytes.Buffer{}
+	err = s.sendHeartbeat(newBufferedSpeedDaemonConn(buf))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "41", hex.EncodeToString(buf.Bytes()))
 }
 
-func TestParsePlate2(t *testing.T) {
-	buf, err := hex.DecodeString("0752453035424b470001e240")
+func TestSendError(t *testing.T) {
+	logger, err := zap.NewDevelopment()
 	assert.NoError(t, err)
 
-	r := bytes.NewReader(buf)
-	plate, err := parsePlate(r)
+	s, err := NewServer(ProtoHackersModeSpeedDaemon, 35000, logger)
 	assert.NoError(t, err)
 
-	assert.Equal(t, "RE05BKG", plate.plate)
-	assert.Equal(t, 123456, plate.timestamp)
+	buf := &bytes.Buffer{}
+	s.sendError(newBufferedSpeedDaemonConn(buf), errors.New("bad"))
+
+	assert.Equal(t, "1003626164", hex.EncodeToString(buf.Bytes()))
 }
 
-func TestParseWantHeartbeat(t *testing.T) {
-	buf, err := hex.DecodeString("0000000a")
+func TestHandleSpeedDaemonPendingTicket(t *testing.T) {
+	mode := ProtoHackersModeSpeedDaemon
+	port := 35000
+	logger, err := zap.NewDevelopment()
 	assert.NoError(t, err)
 
-	r := bytes.NewReader(buf)
-	wantHeartbeat, err := parseWantHeartbeat(r)
+	s, err := NewServer(mode, port, logger, WithSpeedDaemonDbService(services.NewSpeedDaemonService()))
 	assert.NoError(t, err)
 
-	assert.Equal(t, 10, wantHeartbeat.interval)
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	tcpAddr := &net.TCPAddr{
+		IP:   net.ParseIP("127.0.0.1"),
+		Port: port,
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	camera1, err := net.DialTCP("tcp4", nil, tcpAddr)
+	assert.NoError(t, err)
+	defer camera1.Close()
+
+	camera2, err := net.DialTCP("tcp4", nil, tcpAddr)
+	assert.NoError(t, err)
+	defer camera2.Close()
+
+	// IAmCamera{road: 123, mile: 8, limit: 60}, Plate{plate: "UN1X", timestamp: 0}
+	writeHex(t, "80007b0008003c", camera1)
+	writeHex(t, "2004554e315800000000", camera1)
+
+	// IAmCamera{road: 123, mile: 9, limit: 60}, Plate{plate: "UN1X", timestamp: 45}
+	writeHex(t, "80007b0009003c", camera2)
+	writeHex(t, "2004554e31580000002d", camera2)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the dispatcher connects after the ticket was issued
+	dispatcher, err := net.DialTCP("tcp4", nil, tcpAddr)
+	assert.NoError(t, err)
+	defer dispatcher.Close()
+
+	// IAmDispatcher{roads: [123]}
+	writeHex(t, "8101007b", dispatcher)
+
+	dispatcher.SetReadDeadline(time.Now().Add(time.Second))
+	ticket, err := decodeTicket(dispatcher)
+	assert.NoError(t, err)
+
+	assert.Equal(t, &services.Ticket{
+		Plate:      "UN1X",
+		Road:       123,
+		Mile1:      8,
+		Timestamp1: 0,
+		Mile2:      9,
+		Timestamp2: 45,
+		Speed:      8000,
+	}, ticket)
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestNextSpeedDaemonClientState(t *testing.T) {
+	unidentified := speedDaemonClientUnidentified
+	camera := speedDaemonClientCamera
+	dispatcher := speedDaemonClientDispatcher
+
+	tests := []struct {
+		state         speedDaemonClientState
+		msgType       proto.MsgType
+		expectedState speedDaemonClientState
+		expectedErr   string
+	}{
+		{unidentified, proto.MsgTypeIAmCamera, camera, ""},
+		{unidentified, proto.MsgTypeIAmDispatcher, dispatcher, ""},
+		{unidentified, proto.MsgTypeWantHeartbeat, unidentified, ""},
+		{unidentified, proto.MsgTypePlate, unidentified, "illegal msg: Plate from unidentified client, only cameras can send plates"},
+		{unidentified, proto.MsgTypeError, unidentified, "illegal msg: Error is a server message"},
+		{unidentified, proto.MsgTypeTicket, unidentified, "illegal msg: Ticket is a server message"},
+		{unidentified, proto.MsgTypeHeartbeat, unidentified, "illegal msg: Heartbeat is a server message"},
+
+		{camera, proto.MsgTypeIAmCamera, camera, "illegal msg: IAmCamera from a client already identified as camera"},
+		{camera, proto.MsgTypeIAmDispatcher, camera, "illegal msg: IAmDispatcher from a client already identified as camera"},
+		{camera, proto.MsgTypeWantHeartbeat, camera, ""},
+		{camera, proto.MsgTypePlate, camera, ""},
+		{camera, proto.MsgTypeError, camera, "illegal msg: Error is a server message"},
+		{camera, proto.MsgTypeTicket, camera, "illegal msg: Ticket is a server message"},
+		{camera, proto.MsgTypeHeartbeat, camera, "illegal msg: Heartbeat is a server message"},
+
+		{dispatcher, proto.MsgTypeIAmCamera, dispatcher, "illegal msg: IAmCamera from a client already identified as dispatcher"},
+		{dispatcher, proto.MsgTypeIAmDispatcher, dispatcher, "illegal msg: IAmDispatcher from a client already identified as dispatcher"},
+		{dispatcher, proto.MsgTypeWantHeartbeat, dispatcher, ""},
+		{dispatcher, proto.MsgTypePlate, dispatcher, "illegal msg: Plate from dispatcher, only cameras can send plates"},
+		{dispatcher, proto.MsgTypeError, dispatcher, "illegal msg: Error is a server message"},
+		{dispatcher, proto.MsgTypeTicket, dispatcher, "illegal msg: Ticket is a server message"},
+		{dispatcher, proto.MsgTypeHeartbeat, dispatcher, "illegal msg: Heartbeat is a server message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s", tt.state, tt.msgType), func(t *testing.T) {
+			state, err := nextSpeedDaemonClientState(tt.state, tt.msgType)
+			if tt.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.expectedErr)
+			}
+			assert.Equal(t, tt.expectedState, state)
+		})
+	}
 }
 
-func TestParseWantHeartbeat2(t *testing.T) {
-	buf, err := hex.DecodeString("000004db")
+func TestHandleSpeedDaemonIllegalTransitions(t *testing.T) {
+	mode := ProtoHackersModeSpeedDaemon
+	port := 35000
+	logger, err := zap.NewDevelopment()
 	assert.NoError(t, err)
 
-	r := bytes.NewReader(buf)
-	wantHeartbeat, err := parseWantHeartbeat(r)
+	s, err := NewServer(mode, port, logger, WithSpeedDaemonDbService(services.NewSpeedDaemonService()))
 	assert.NoError(t, err)
 
-	assert.Equal(t, 1243, wantHeartbeat.interval)
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	tcpAddr := &net.TCPAddr{
+		IP:   net.ParseIP("127.0.0.1"),
+		Port: port,
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name        string
+		hex         string
+		expectedErr string
+	}{
+		{"plate before IAmCamera", "2004554e3158000003e8", "illegal msg: Plate from unidentified client, only cameras can send plates"},
+		{"plate from dispatcher", "8101007b" + "2004554e3158000003e8", "illegal msg: Plate from dispatcher, only cameras can send plates"},
+		{"camera identifies twice", "80007b0008003c" + "80007b0009003c", "illegal msg: IAmCamera from a client already identified as camera"},
+		{"camera becomes dispatcher", "80007b0008003c" + "8101007b", "illegal msg: IAmDispatcher from a client already identified as camera"},
+		{"dispatcher becomes camera", "8101007b" + "80007b0008003c", "illegal msg: IAmCamera from a client already identified as dispatcher"},
+		{"heartbeat from client", "41", "illegal msg: Heartbeat is a server message"},
+		{"ticket from camera", "80007b0008003c" + "2104554e3158004200640001e240006e0001e3a82710", "illegal msg: Ticket is a server message"},
+		{"unknown message", "12", "unknown message type 0x12"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.DialTCP("tcp4", nil, tcpAddr)
+			assert.NoError(t, err)
+			defer conn.Close()
+
+			writeHex(t, tt.hex, conn)
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			r := bufio.NewReader(conn)
+
+			msg, err := proto.Decode(r)
+			assert.NoError(t, err)
+			assert.Equal(t, &proto.Error{Msg: tt.expectedErr}, msg)
+
+			// server closes the connection after the error
+			_, err = proto.Decode(r)
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
 }
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// tlsReloader holds the server certificate and the client certificates authorities,
+// handshakes use the latest files loaded
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	cert         *tls.Certificate
+	// clientCAs verify client certificates, nil if clients aren't required to present one
+	clientCAs *x509.CertPool
+	lock      *sync.RWMutex
+}
+
+func newTLSReloader(certFile string, keyFile string, clientCAFile string) (*tlsReloader, error) {
+	r := &tlsReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		lock:         &sync.RWMutex{},
+	}
+
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// reload reads the files again, the previous certificates are kept if they can't be loaded
+func (r *tlsReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load tls certificate")
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pemData, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read tls client ca")
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pemData) {
+			return fmt.Errorf("no certificate found in tls client ca %s", r.clientCAFile)
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.cert = &cert
+	r.clientCAs = clientCAs
+
+	return nil
+}
+
+// config returns a tls config picking up the current certificates on every handshake
+func (r *tlsReloader) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				cfg.ClientCAs = r.clientCAs
+			}
+
+			return cfg, nil
+		},
+	}
+}
+
+// ReloadTLS reads the tls certificate, key and client ca files again, new connections use them
+func (s *Server) ReloadTLS() error {
+	if s.tls == nil {
+		return errors.New("tls not enabled")
+	}
+
+	err := s.tls.reload()
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("tls certificates reloaded", zap.String("cert", s.tls.certFile))
+
+	return nil
+}
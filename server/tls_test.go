@@ -0,0 +1,335 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert generates a certificate valid for localhost, signed by parent or self signed if parent is nil
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+// writeFiles writes the certificate and key to dir, returning their paths
+func (c *testCert) writeFiles(t *testing.T, dir string) (string, string) {
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	assert.NoError(t, os.WriteFile(certFile, c.certPEM, 0600))
+	assert.NoError(t, os.WriteFile(keyFile, c.keyPEM, 0600))
+
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	assert.NoError(t, err)
+	return cert
+}
+
+func dialTLS(port int, cfg *tls.Config) (*tls.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), cfg)
+}
+
+func TestTLS(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	serverCert := newTestCert(t, "server", nil)
+	certFile, keyFile := serverCert.writeFiles(t, t.TempDir())
+
+	s, err := NewMultiServer([]Listener{
+		{Mode: ProtoHackersModeEcho, Port: 35000},
+		{Mode: ProtoHackersModePrimeTime, Port: 35001},
+		{Mode: ProtoHackersModeMeans, Port: 35002},
+	}, logger, WithTLS(certFile, keyFile))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.cert)
+	cfg := &tls.Config{RootCAs: roots}
+
+	// echo
+	echoConn, err := dialTLS(35000, cfg)
+	assert.NoError(t, err)
+	defer echoConn.Close()
+
+	_, err = echoConn.Write([]byte("ABC"))
+	assert.NoError(t, err)
+	assert.NoError(t, echoConn.CloseWrite())
+
+	readData, err := io.ReadAll(echoConn)
+	assert.NoError(t, err)
+	assert.Equal(t, "ABC", string(readData))
+
+	// prime
+	primeConn, err := dialTLS(35001, cfg)
+	assert.NoError(t, err)
+	defer primeConn.Close()
+
+	_, err = primeConn.Write([]byte("{\"method\":\"isPrime\",\"number\":7}\n"))
+	assert.NoError(t, err)
+
+	sc := bufio.NewScanner(primeConn)
+	assert.True(t, sc.Scan())
+	assert.Equal(t, "{\"method\":\"isPrime\",\"prime\":true}", sc.Text())
+
+	// means
+	meansConn, err := dialTLS(35002, cfg)
+	assert.NoError(t, err)
+	defer meansConn.Close()
+
+	_, err = meansConn.Write([]byte{
+		'I', 0, 0, 0x30, 0x39, 0, 0, 0, 0x65,
+		'I', 0, 0, 0x30, 0x3a, 0, 0, 0, 0x66,
+		'Q', 0, 0, 0x30, 0, 0, 0, 0x40, 0,
+	})
+	assert.NoError(t, err)
+
+	resp := make([]byte, 4)
+	_, err = io.ReadFull(meansConn, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(101), binary.BigEndian.Uint32(resp))
+
+	// plain tcp clients can't talk to the server
+	plainConn, err := net.DialTCP("tcp4", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 35000})
+	assert.NoError(t, err)
+	defer plainConn.Close()
+
+	_, err = plainConn.Write([]byte("ABC\n"))
+	assert.NoError(t, err)
+
+	plainConn.SetReadDeadline(time.Now().Add(time.Second))
+	readData, _ = io.ReadAll(plainConn)
+	assert.NotEqual(t, "ABC\n", string(readData))
+
+	done <- true
+	<-stopped
+}
+
+func TestTLSClientCA(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	serverCert := newTestCert(t, "server", nil)
+	certFile, keyFile := serverCert.writeFiles(t, t.TempDir())
+
+	ca := newTestCert(t, "client ca", nil)
+	caDir := t.TempDir()
+	caFile, _ := ca.writeFiles(t, caDir)
+
+	s, err := NewServer(ProtoHackersModeEcho, 35000, logger, WithTLS(certFile, keyFile), WithTLSClientCA(caFile))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.cert)
+
+	echo := func(cfg *tls.Config) error {
+		conn, err := dialTLS(35000, cfg)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("ABC"))
+		if err != nil {
+			return err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(conn, make([]byte, 3))
+		return err
+	}
+
+	// no client certificate
+	err = echo(&tls.Config{RootCAs: roots})
+	assert.Error(t, err)
+
+	// client certificate signed by another authority
+	otherCert := newTestCert(t, "other client", nil)
+	err = echo(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{otherCert.tlsCertificate(t)}})
+	assert.Error(t, err)
+
+	// client certificate signed by the client ca
+	clientCert := newTestCert(t, "client", ca)
+	err = echo(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert.tlsCertificate(t)}})
+	assert.NoError(t, err)
+
+	done <- true
+	<-stopped
+}
+
+func TestTLSReload(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	certA := newTestCert(t, "cert a", nil)
+	certB := newTestCert(t, "cert b", nil)
+
+	dir := t.TempDir()
+	certFile, keyFile := certA.writeFiles(t, dir)
+
+	s, err := NewServer(ProtoHackersModeEcho, 35000, logger, WithTLS(certFile, keyFile))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+	stopped := make(chan bool)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certA.cert)
+	roots.AddCert(certB.cert)
+	cfg := &tls.Config{RootCAs: roots}
+
+	peerCommonName := func() string {
+		conn, err := dialTLS(35000, cfg)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer conn.Close()
+
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	assert.Equal(t, "cert a", peerCommonName())
+
+	// connections opened before the reload keep working
+	oldConn, err := dialTLS(35000, cfg)
+	assert.NoError(t, err)
+	defer oldConn.Close()
+
+	certB.writeFiles(t, dir)
+	assert.NoError(t, s.ReloadTLS())
+
+	assert.Equal(t, "cert b", peerCommonName())
+
+	_, err = oldConn.Write([]byte("ABC"))
+	assert.NoError(t, err)
+	_, err = io.ReadFull(oldConn, make([]byte, 3))
+	assert.NoError(t, err)
+
+	// broken files don't replace the current certificate
+	assert.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0600))
+	assert.ErrorContains(t, s.ReloadTLS(), "failed to load tls certificate")
+
+	assert.Equal(t, "cert b", peerCommonName())
+
+	done <- true
+	<-stopped
+}
+
+func TestTLSInvalidConfig(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+
+	_, err = NewServer(ProtoHackersModeEcho, 35000, logger, WithTLS(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")))
+	assert.ErrorContains(t, err, "failed to load tls certificate")
+
+	_, err = NewServer(ProtoHackersModeEcho, 35000, logger, WithTLSClientCA(filepath.Join(dir, "ca.pem")))
+	assert.ErrorContains(t, err, "tls client ca set without tls certificate")
+
+	certFile, keyFile := newTestCert(t, "server", nil).writeFiles(t, dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, []byte("garbage"), 0600))
+
+	_, err = NewServer(ProtoHackersModeEcho, 35000, logger, WithTLS(certFile, keyFile), WithTLSClientCA(caFile))
+	assert.ErrorContains(t, err, "no certificate found in tls client ca")
+
+	s, err := NewServer(ProtoHackersModeEcho, 35000, logger)
+	assert.NoError(t, err)
+	assert.ErrorContains(t, s.ReloadTLS(), "tls not enabled")
+}
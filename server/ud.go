@@ -2,34 +2,70 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 
 	"go.uber.org/zap"
 )
 
-var maxUDContentSize = 1000
+const ProtoHackersModeUnusualDatabase = "ud"
 
-func (s *Server) HandleUnusualDatabase(conn *net.UDPConn) {
-	defer conn.Close()
+func init() {
+	RegisterMode(ProtoHackersModeUnusualDatabase, TransportUDP, func(s *Server) (Handler, error) {
+		return HandlerFunc(s.HandleUnusualDatabase), nil
+	})
+}
+
+const DefaultUDMaxContentSize = 1000
+
+const DefaultUDWorkers = 64
+
+// HandleUnusualDatabase serves the datagrams received by the listening conn, which must be a net.PacketConn
+func (s *Server) HandleUnusualDatabase(ctx context.Context, listenerConn net.Conn) {
+	defer listenerConn.Close()
+
+	conn, ok := listenerConn.(net.PacketConn)
+	if !ok {
+		s.handlerError(ProtoHackersModeUnusualDatabase, "ud conn is not a packet conn", zap.String("addr", listenerConn.LocalAddr().String()))
+		return
+	}
 
 	s.logger.Info("ud waiting for conns", zap.String("addr", conn.LocalAddr().String()))
 
+	// workers bounds the datagrams processed at once, whatever the number of remote addresses
+	workers := make(chan struct{}, s.udWorkers)
+
 	for {
-		inputData := make([]byte, maxUDContentSize)
-		n, addr, err := conn.ReadFromUDP(inputData)
+		inputData := make([]byte, s.udMaxContentSize)
+		n, addr, err := conn.ReadFrom(inputData)
+		if errors.Is(err, net.ErrClosed) {
+			s.logger.Info("ud conn closed")
+			return
+		}
 		if err != nil {
-			s.logger.Error("failed to read from udp", zap.Error(err))
+			s.handlerError(ProtoHackersModeUnusualDatabase, "failed to read from udp", zap.Error(err))
 			continue
 		}
 
+		s.metrics.bytesRead.Add(float64(n), ProtoHackersModeUnusualDatabase)
+
 		s.logger.Info("received command", zap.String("command", string(inputData[:n])), zap.String("addr", addr.String()))
 
-		go s.unusualDatabaseResponse(conn, addr, inputData[:n])
+		select {
+		case workers <- struct{}{}:
+			go func() {
+				defer func() { <-workers }()
+				s.unusualDatabaseResponse(conn, addr, inputData[:n])
+			}()
+		default:
+			s.datagramDropped(ProtoHackersModeUnusualDatabase, addr, udpDropWorkersBusy)
+		}
 	}
 }
 
-func (s *Server) unusualDatabaseResponse(conn *net.UDPConn, addr *net.UDPAddr, inputData []byte) {
+func (s *Server) unusualDatabaseResponse(conn net.PacketConn, addr net.Addr, inputData []byte) {
 	if n := bytes.Index(inputData, []byte("=")); n > -1 {
 		// set
 		key := string(inputData[:n])
@@ -45,10 +81,12 @@ func (s *Server) unusualDatabaseResponse(conn *net.UDPConn, addr *net.UDPAddr, i
 		key := string(inputData)
 		value := s.unusualDbSvc.Get(key)
 
-		_, err := conn.WriteToUDP([]byte(fmt.Sprintf("%s=%s", key, value)), addr)
+		n, err := conn.WriteTo([]byte(fmt.Sprintf("%s=%s", key, value)), addr)
 		if err != nil {
-			s.logger.Error("failed to write to udp", zap.Error(err))
+			s.handlerError(ProtoHackersModeUnusualDatabase, "failed to write to udp", zap.Error(err))
 			return
 		}
+
+		s.metrics.bytesWritten.Add(float64(n), ProtoHackersModeUnusualDatabase)
 	}
 }
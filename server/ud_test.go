@@ -26,7 +26,8 @@ func TestHandleUnusualDatabase(t *testing.T) {
 	key := "my-key"
 	value := "my-value"
 
-	uDSvc.EXPECT().Set(key, value).Return()
+	setDone := make(chan bool)
+	uDSvc.EXPECT().Set(key, value).Do(func(key string, value string) { close(setDone) })
 	uDSvc.EXPECT().Get(key).Return(value)
 
 	s, err := NewServer(mode, port, logger, WithUnusualDbService(uDSvc))
@@ -53,7 +54,7 @@ func TestHandleUnusualDatabase(t *testing.T) {
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
-		outputData := make([]byte, maxUDContentSize)
+		outputData := make([]byte, DefaultUDMaxContentSize)
 		n, _, err := conn.ReadFromUDP(outputData)
 		assert.NoError(t, err)
 
@@ -68,9 +69,74 @@ func TestHandleUnusualDatabase(t *testing.T) {
 
 	logger.Info("wrote set query", zap.Int("n", n))
 
+	// datagrams are processed concurrently, the get must follow the set
+	select {
+	case <-setDone:
+	case <-time.After(time.Second):
+		assert.Fail(t, "set not processed")
+	}
+
 	inputData = []byte(key)
 	_, err = conn.Write(inputData)
 	assert.NoError(t, err)
 
 	wg.Wait()
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestHandleUnusualDatabaseWorkersBusy(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mode := ProtoHackersModeUnusualDatabase
+	port := 35000
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	uDSvc := mocks.NewMockUnusualDbService(ctrl)
+
+	// the only worker is stuck on the first get, the next datagrams are dropped
+	release := make(chan bool)
+	uDSvc.EXPECT().Get("key").DoAndReturn(func(key string) string {
+		<-release
+		return "value"
+	}).Times(1)
+
+	s, err := NewServer(mode, port, logger, WithUnusualDbService(uDSvc), WithUDWorkers(1))
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write([]byte("key"))
+		assert.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, float64(2), s.metrics.udpDropped.Value(string(ProtoHackersModeUnusualDatabase), udpDropWorkersBusy))
+
+	close(release)
+
+	outputData := make([]byte, DefaultUDMaxContentSize)
+	err = conn.SetReadDeadline(time.Now().Add(time.Second))
+	assert.NoError(t, err)
+	n, err := conn.Read(outputData)
+	assert.NoError(t, err)
+	assert.Equal(t, "key=value", string(outputData[:n]))
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
 }
@@ -1,45 +1,171 @@
 package services
 
 import (
+	"errors"
+	"fmt"
 	"regexp"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/didil/protohackers/metrics"
 	"go.uber.org/zap"
 )
 
 type ChatService interface {
 	IsValidName(name string) bool
-	AddUser(name string) (int, chan string)
-	RemoveUser(id int)
+	IsValidRoomName(room string) bool
+	AddUser(name string) (int, chan string, ChatRoomSnapshot, error)
+	RemoveUser(id int) (string, bool)
+	JoinRoom(id int, room string) (string, ChatRoomSnapshot, error)
 	ListCurrentUsersNames() []string
-	Broadcast(userId int, event string)
+	ListRoomUsersNames(room string) []string
+	ListRooms() []string
+	Broadcast(room string, userId int, event string)
+	Post(room string, userId int, msg string)
+	SendTo(name string, msg string) bool
 }
 
+// ChatMessage is a message kept in a room history
+type ChatMessage struct {
+	Time time.Time
+	Msg  string
+}
+
+// ChatRoomSnapshot is the state of a room a user enters, taken as the user enters it
+type ChatRoomSnapshot struct {
+	// Users are the sorted names of the other users in the room
+	Users   []string
+	History []ChatMessage
+}
+
+// DefaultChatRoom is the room users are in after joining, it behaves like the plain budgetchat room
+const DefaultChatRoom = "lobby"
+
+// ChatSlowConsumerPolicy decides what happens to a message for a user whose queue is full
+type ChatSlowConsumerPolicy string
+
+const (
+	// ChatSlowConsumerDropOldest drops the oldest queued message to make room for the new one
+	ChatSlowConsumerDropOldest ChatSlowConsumerPolicy = "drop-oldest"
+	// ChatSlowConsumerDropNewest drops the new message
+	ChatSlowConsumerDropNewest ChatSlowConsumerPolicy = "drop-newest"
+	// ChatSlowConsumerDisconnect closes the user channel, the user is expected to be disconnected
+	ChatSlowConsumerDisconnect ChatSlowConsumerPolicy = "disconnect"
+)
+
+var (
+	ErrChatNameTaken    = errors.New("name already taken")
+	ErrChatNameReserved = errors.New("name reserved")
+)
+
 type chatService struct {
-	nameRegex    *regexp.Regexp
-	lastId       int
-	users        map[int]*ChatUser
+	nameRegex     *regexp.Regexp
+	roomNameRegex *regexp.Regexp
+	lastId        int
+	users         map[int]*ChatUser
+	// userChannels are the queues of the users, disconnected slow users have none
 	userChannels map[int](chan string)
-	lock         *sync.Mutex
-	logger       *zap.Logger
+	// channelsBuffer is the number of messages queued for each user
+	channelsBuffer int
+	// reservedNames can't be used by users, they are lower case
+	reservedNames      map[string]bool
+	slowConsumerPolicy ChatSlowConsumerPolicy
+	// historySize is the number of messages kept for each room, 0 disables the history
+	historySize int
+	// histories are the rooms recent messages, indexed by room
+	histories map[string]*chatHistory
+	metrics   *chatMetrics
+	lock      *sync.Mutex
+	logger    *zap.Logger
+}
+
+type chatMetrics struct {
+	messagesDropped  *metrics.Counter
+	slowDisconnected *metrics.Counter
+}
+
+func newChatMetrics(registry *metrics.Registry) *chatMetrics {
+	return &chatMetrics{
+		messagesDropped:  registry.NewCounter("protohackers_chat_messages_dropped_total", "Chat messages dropped because the user queue was full, by slow consumer policy.", "policy"),
+		slowDisconnected: registry.NewCounter("protohackers_chat_slow_users_disconnected_total", "Chat users disconnected because their queue was full."),
+	}
 }
 
 type ChatUser struct {
 	ID   int
 	Name string
+	Room string
+}
+
+type ChatServiceOpt func(*chatService) *chatService
+
+// WithChatReservedNames forbids users to pick one of names, whatever the case
+func WithChatReservedNames(names ...string) ChatServiceOpt {
+	return func(svc *chatService) *chatService {
+		for _, name := range names {
+			svc.reservedNames[strings.ToLower(name)] = true
+		}
+		return svc
+	}
+}
+
+// WithChatSlowConsumerPolicy sets what happens to messages for users whose queue is full, drop-oldest by default
+func WithChatSlowConsumerPolicy(policy ChatSlowConsumerPolicy) ChatServiceOpt {
+	return func(svc *chatService) *chatService {
+		svc.slowConsumerPolicy = policy
+		return svc
+	}
+}
+
+// WithChatHistorySize keeps the last size messages of each room, none by default
+func WithChatHistorySize(size int) ChatServiceOpt {
+	return func(svc *chatService) *chatService {
+		svc.historySize = size
+		return svc
+	}
+}
+
+// WithChatMetrics registers the service metrics in registry
+func WithChatMetrics(registry *metrics.Registry) ChatServiceOpt {
+	return func(svc *chatService) *chatService {
+		svc.metrics = newChatMetrics(registry)
+		return svc
+	}
+}
+
+// WithChatChannelsBuffer sets the number of messages queued for each user
+func WithChatChannelsBuffer(channelsBuffer int) ChatServiceOpt {
+	return func(svc *chatService) *chatService {
+		svc.channelsBuffer = channelsBuffer
+		return svc
+	}
 }
 
-func NewChatService(logger *zap.Logger) ChatService {
+func NewChatService(logger *zap.Logger, opts ...ChatServiceOpt) ChatService {
 	nameRegex := regexp.MustCompile("^[a-zA-Z0-9]*$")
-	return &chatService{
-		nameRegex:    nameRegex,
-		lastId:       0,
-		users:        map[int]*ChatUser{},
-		userChannels: map[int](chan string){},
-		lock:         &sync.Mutex{},
-		logger:       logger,
+	roomNameRegex := regexp.MustCompile("^[a-zA-Z0-9_-]*$")
+	svc := &chatService{
+		nameRegex:          nameRegex,
+		roomNameRegex:      roomNameRegex,
+		lastId:             0,
+		users:              map[int]*ChatUser{},
+		userChannels:       map[int](chan string){},
+		channelsBuffer:     DefaultChatChannelsBuffer,
+		reservedNames:      map[string]bool{},
+		slowConsumerPolicy: ChatSlowConsumerDropOldest,
+		histories:          map[string]*chatHistory{},
+		metrics:            newChatMetrics(metrics.NewRegistry()),
+		lock:               &sync.Mutex{},
+		logger:             logger,
 	}
+
+	for _, opt := range opts {
+		svc = opt(svc)
+	}
+
+	return svc
 }
 
 func (svc *chatService) IsValidName(name string) bool {
@@ -53,44 +179,134 @@ func (svc *chatService) IsValidName(name string) bool {
 	return svc.nameRegex.MatchString(name)
 }
 
-const chatChannelsBuffer = 256
+// IsValidRoomName accepts room names of 1 to 32 letters, digits, dashes or underscores
+func (svc *chatService) IsValidRoomName(room string) bool {
+	if len(room) == 0 {
+		return false
+	}
+	if len(room) > 32 {
+		return false
+	}
+
+	return svc.roomNameRegex.MatchString(room)
+}
+
+const DefaultChatChannelsBuffer = 256
 
-func (svc *chatService) AddUser(name string) (int, chan string) {
+// AddUser adds the user to the default room and returns the room snapshot, its users are told about
+// the messages posted from then on and its history holds exactly the ones posted before, names are unique whatever the case
+func (svc *chatService) AddUser(name string) (int, chan string, ChatRoomSnapshot, error) {
 	svc.lock.Lock()
 	defer svc.lock.Unlock()
 
+	if svc.reservedNames[strings.ToLower(name)] {
+		return 0, nil, ChatRoomSnapshot{}, ErrChatNameReserved
+	}
+	if svc.findUser(name) != nil {
+		return 0, nil, ChatRoomSnapshot{}, ErrChatNameTaken
+	}
+
+	snapshot := svc.snapshot(DefaultChatRoom)
+
 	svc.lastId++
 
-	user := &ChatUser{ID: svc.lastId, Name: name}
-	c := make(chan string, chatChannelsBuffer)
+	user := &ChatUser{ID: svc.lastId, Name: name, Room: DefaultChatRoom}
+	c := make(chan string, svc.channelsBuffer)
 
 	svc.users[user.ID] = user
 	svc.userChannels[user.ID] = c
 
-	return user.ID, c
+	return user.ID, c, snapshot, nil
+}
+
+// snapshot returns the state of room for a user entering it, the lock must be held
+func (svc *chatService) snapshot(room string) ChatRoomSnapshot {
+	return ChatRoomSnapshot{
+		Users:   svc.usersNames(func(u *ChatUser) bool { return u.Room == room }),
+		History: svc.history(room),
+	}
+}
+
+// findUser returns the user called name, whatever the case, the lock must be held
+func (svc *chatService) findUser(name string) *ChatUser {
+	for _, u := range svc.users {
+		if strings.EqualFold(u.Name, name) {
+			return u
+		}
+	}
+
+	return nil
 }
 
-func (svc *chatService) RemoveUser(id int) {
+// RemoveUser removes the user and returns the room it was in, or false if it was already removed
+func (svc *chatService) RemoveUser(id int) (string, bool) {
 	svc.lock.Lock()
 	defer svc.lock.Unlock()
 
-	if _, ok := svc.users[id]; !ok {
+	user, ok := svc.users[id]
+	if !ok {
 		// user already removed
-		return
+		return "", false
 	}
 
 	delete(svc.users, id)
 
-	channel := svc.userChannels[id]
-	close(channel)
-	delete(svc.userChannels, id)
+	// disconnected slow users channels are already closed
+	if channel, ok := svc.userChannels[id]; ok {
+		close(channel)
+		delete(svc.userChannels, id)
+	}
+
+	svc.pruneHistory(user.Room)
+
+	return user.Room, true
+}
+
+// JoinRoom moves the user to room and returns the room it left and the snapshot of the new room,
+// taken as the user joined like the AddUser one
+func (svc *chatService) JoinRoom(id int, room string) (string, ChatRoomSnapshot, error) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+
+	user, ok := svc.users[id]
+	if !ok {
+		return "", ChatRoomSnapshot{}, fmt.Errorf("user %d not found", id)
+	}
+
+	snapshot := svc.snapshot(room)
+
+	previous := user.Room
+	user.Room = room
+
+	svc.pruneHistory(previous)
+
+	return previous, snapshot, nil
 }
 
 func (svc *chatService) ListCurrentUsersNames() []string {
+	return svc.listUsersNames(func(u *ChatUser) bool { return true })
+}
+
+// ListRoomUsersNames returns the sorted names of the users in room
+func (svc *chatService) ListRoomUsersNames(room string) []string {
+	return svc.listUsersNames(func(u *ChatUser) bool { return u.Room == room })
+}
+
+func (svc *chatService) listUsersNames(match func(u *ChatUser) bool) []string {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+
+	return svc.usersNames(match)
+}
+
+// usersNames returns the sorted names of the users matching, the lock must be held
+func (svc *chatService) usersNames(match func(u *ChatUser) bool) []string {
 	names := make([]string, 0, len(svc.users))
 
 	for _, u := range svc.users {
-		names = append(names, u.Name)
+		if match(u) {
+			names = append(names, u.Name)
+		}
 	}
 
 	sort.Strings(names)
@@ -98,14 +314,167 @@ func (svc *chatService) ListCurrentUsersNames() []string {
 	return names
 }
 
-func (svc *chatService) Broadcast(userId int, msg string) {
+// ListRooms returns the sorted names of the rooms with users in them, the default room is always listed
+func (svc *chatService) ListRooms() []string {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+
+	rooms := []string{DefaultChatRoom}
+	seen := map[string]bool{DefaultChatRoom: true}
+
+	for _, u := range svc.users {
+		if !seen[u.Room] {
+			seen[u.Room] = true
+			rooms = append(rooms, u.Room)
+		}
+	}
+
+	sort.Strings(rooms)
+
+	return rooms
+}
+
+// Broadcast sends msg to the users in room, except the sender
+func (svc *chatService) Broadcast(room string, userId int, msg string) {
 	svc.lock.Lock()
 	defer svc.lock.Unlock()
 
-	for k, c := range svc.userChannels {
-		// announce to other users only
-		if k != userId {
-			c <- msg
+	svc.broadcast(room, userId, msg)
+}
+
+// broadcast sends msg to the users in room, except the sender, the lock must be held
+func (svc *chatService) broadcast(room string, userId int, msg string) {
+	for k := range svc.userChannels {
+		// announce to other users of the room only
+		if k != userId && svc.users[k].Room == room {
+			svc.deliver(k, msg)
+		}
+	}
+}
+
+// Post broadcasts msg to the users in room, except the sender, and keeps it in the room history
+func (svc *chatService) Post(room string, userId int, msg string) {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+
+	if svc.historySize > 0 {
+		h, ok := svc.histories[room]
+		if !ok {
+			h = newChatHistory(svc.historySize)
+			svc.histories[room] = h
+		}
+		h.add(ChatMessage{Time: time.Now(), Msg: msg})
+	}
+
+	svc.broadcast(room, userId, msg)
+}
+
+// history returns the recent messages of room, oldest first, the lock must be held
+func (svc *chatService) history(room string) []ChatMessage {
+	h, ok := svc.histories[room]
+	if !ok {
+		return []ChatMessage{}
+	}
+
+	return h.messages()
+}
+
+// pruneHistory forgets the history of room once nobody is in it, except for the default room,
+// the lock must be held
+func (svc *chatService) pruneHistory(room string) {
+	if room == DefaultChatRoom {
+		return
+	}
+
+	for _, u := range svc.users {
+		if u.Room == room {
+			return
+		}
+	}
+
+	delete(svc.histories, room)
+}
+
+// deliver queues msg for the user without blocking, applying the slow consumer policy if the queue is full,
+// the lock must be held
+func (svc *chatService) deliver(id int, msg string) {
+	c, ok := svc.userChannels[id]
+	if !ok {
+		// disconnected slow user
+		return
+	}
+
+	select {
+	case c <- msg:
+		return
+	default:
+	}
+
+	switch svc.slowConsumerPolicy {
+	case ChatSlowConsumerDropNewest:
+		svc.metrics.messagesDropped.Inc(string(svc.slowConsumerPolicy))
+	case ChatSlowConsumerDisconnect:
+		svc.logger.Info("disconnecting slow chat user", zap.Int("userId", id))
+		svc.metrics.slowDisconnected.Inc()
+		// the user stays listed until it is removed, but gets no more messages
+		close(c)
+		delete(svc.userChannels, id)
+	default:
+		// make room by dropping the oldest message, unless the user read it meanwhile
+		select {
+		case <-c:
+			svc.metrics.messagesDropped.Inc(string(svc.slowConsumerPolicy))
+		default:
+		}
+		// only senders holding the lock fill the channel, so there is room now
+		select {
+		case c <- msg:
+		default:
+			svc.metrics.messagesDropped.Inc(string(svc.slowConsumerPolicy))
 		}
 	}
 }
+
+// SendTo sends msg to the user called name, whatever its room, and returns false if there is no such user
+func (svc *chatService) SendTo(name string, msg string) bool {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+
+	user := svc.findUser(name)
+	if user == nil {
+		return false
+	}
+
+	svc.deliver(user.ID, msg)
+
+	return true
+}
+
+// chatHistory is a ring buffer of the last messages of a room
+type chatHistory struct {
+	entries []ChatMessage
+	// next is the position of the next message, the oldest one once the buffer is full
+	next int
+	full bool
+}
+
+func newChatHistory(size int) *chatHistory {
+	return &chatHistory{entries: make([]ChatMessage, size)}
+}
+
+func (h *chatHistory) add(m ChatMessage) {
+	h.entries[h.next] = m
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// messages returns the messages oldest first
+func (h *chatHistory) messages() []ChatMessage {
+	if !h.full {
+		return append([]ChatMessage{}, h.entries[:h.next]...)
+	}
+
+	return append(append([]ChatMessage{}, h.entries[h.next:]...), h.entries[:h.next]...)
+}
@@ -1,7 +1,12 @@
 package services
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/didil/protohackers/metrics"
 
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
@@ -23,36 +28,56 @@ func TestIsValidName(t *testing.T) {
 	assert.Equal(t, true, svc.IsValidName("1234567890123456"))
 }
 
+func TestIsValidRoomName(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	svc := NewChatService(logger)
+
+	assert.Equal(t, false, svc.IsValidRoomName(""))
+	assert.Equal(t, false, svc.IsValidRoomName("123456789012345678901234567890123"))
+	assert.Equal(t, false, svc.IsValidRoomName("bad room"))
+	assert.Equal(t, false, svc.IsValidRoomName("games!"))
+
+	assert.Equal(t, true, svc.IsValidRoomName("games"))
+	assert.Equal(t, true, svc.IsValidRoomName("board-games_2"))
+	assert.Equal(t, true, svc.IsValidRoomName("12345678901234567890123456789012"))
+}
+
 func TestAddUsersListCurrentUsersNames(t *testing.T) {
 	logger, err := zap.NewDevelopment()
 	assert.NoError(t, err)
 	svc := NewChatService(logger)
 
-	id, _ := svc.AddUser("mike")
+	id, _, _, _ := svc.AddUser("mike")
 	assert.Equal(t, 1, id)
 	assert.Equal(t, []string{"mike"}, svc.ListCurrentUsersNames())
 
-	id, _ = svc.AddUser("john")
+	id, _, _, _ = svc.AddUser("john")
 	assert.Equal(t, 2, id)
 	assert.Equal(t, []string{"john", "mike"}, svc.ListCurrentUsersNames())
 
-	id, _ = svc.AddUser("mike")
+	_, _, _, err = svc.AddUser("Mike")
+	assert.ErrorIs(t, err, ErrChatNameTaken)
+	assert.Equal(t, []string{"john", "mike"}, svc.ListCurrentUsersNames())
+
+	svc.RemoveUser(1)
+	id, _, _, err = svc.AddUser("mike")
+	assert.NoError(t, err)
 	assert.Equal(t, 3, id)
-	assert.Equal(t, []string{"john", "mike", "mike"}, svc.ListCurrentUsersNames())
 }
 
 func TestAnnounceUser(t *testing.T) {
 	logger, err := zap.NewDevelopment()
 	assert.NoError(t, err)
 	svc := NewChatService(logger)
-	_, c1 := svc.AddUser("mike")
-	_, c2 := svc.AddUser("lara")
+	_, c1, _, _ := svc.AddUser("mike")
+	_, c2, _, _ := svc.AddUser("lara")
 
-	id, c := svc.AddUser("john")
+	id, c, _, _ := svc.AddUser("john")
 
 	broadcastMessage := "* john has entered the room"
 
-	svc.Broadcast(id, broadcastMessage)
+	svc.Broadcast(DefaultChatRoom, id, broadcastMessage)
 
 	msg1 := <-c1
 	assert.Equal(t, broadcastMessage, msg1)
@@ -64,3 +89,290 @@ func TestAnnounceUser(t *testing.T) {
 	msg := <-c
 	assert.Equal(t, "", msg)
 }
+
+func TestChatChannelsBuffer(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	_, c, _, _ := NewChatService(logger).AddUser("alice")
+	assert.Equal(t, DefaultChatChannelsBuffer, cap(c))
+
+	_, c, _, _ = NewChatService(logger, WithChatChannelsBuffer(8)).AddUser("alice")
+	assert.Equal(t, 8, cap(c))
+}
+
+func TestChatRooms(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	svc := NewChatService(logger)
+
+	mikeId, mikeChan, snapshot, _ := svc.AddUser("mike")
+	assert.Empty(t, snapshot.Users)
+	laraId, laraChan, snapshot, _ := svc.AddUser("lara")
+	assert.Equal(t, []string{"mike"}, snapshot.Users)
+	johnId, johnChan, _, _ := svc.AddUser("john")
+
+	// the snapshot lists the users in the room before the user joined
+	previous, snapshot, err := svc.JoinRoom(laraId, "games")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultChatRoom, previous)
+	assert.Empty(t, snapshot.Users)
+	_, snapshot, err = svc.JoinRoom(johnId, "games")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lara"}, snapshot.Users)
+
+	assert.Equal(t, []string{"games", DefaultChatRoom}, svc.ListRooms())
+	assert.Equal(t, []string{"mike"}, svc.ListRoomUsersNames(DefaultChatRoom))
+	assert.Equal(t, []string{"john", "lara"}, svc.ListRoomUsersNames("games"))
+	assert.Equal(t, []string{"john", "lara", "mike"}, svc.ListCurrentUsersNames())
+
+	svc.Broadcast("games", laraId, "[lara] hi")
+	assert.Equal(t, "[lara] hi", <-johnChan)
+	assert.Len(t, laraChan, 0)
+	assert.Len(t, mikeChan, 0)
+
+	room, ok := svc.RemoveUser(johnId)
+	assert.True(t, ok)
+	assert.Equal(t, "games", room)
+	_, ok = svc.RemoveUser(johnId)
+	assert.False(t, ok)
+
+	_, _, err = svc.JoinRoom(johnId, "games")
+	assert.Error(t, err)
+
+	previous, _, err = svc.JoinRoom(laraId, DefaultChatRoom)
+	assert.NoError(t, err)
+	assert.Equal(t, "games", previous)
+	assert.Equal(t, []string{DefaultChatRoom}, svc.ListRooms())
+
+	svc.Broadcast(DefaultChatRoom, mikeId, "[mike] welcome back")
+	assert.Equal(t, "[mike] welcome back", <-laraChan)
+}
+
+func TestChatSendTo(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	svc := NewChatService(logger)
+
+	_, mikeChan, _, _ := svc.AddUser("mike")
+	laraId, laraChan, _, _ := svc.AddUser("lara")
+
+	_, _, err = svc.JoinRoom(laraId, "games")
+	assert.NoError(t, err)
+
+	assert.True(t, svc.SendTo("lara", "[mike -> lara] hi"))
+	assert.Equal(t, "[mike -> lara] hi", <-laraChan)
+	assert.Len(t, mikeChan, 0)
+
+	assert.False(t, svc.SendTo("john", "[mike -> john] hi"))
+}
+
+func TestChatReservedNames(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	svc := NewChatService(logger, WithChatReservedNames("admin", "Server"))
+
+	_, _, _, err = svc.AddUser("Admin")
+	assert.ErrorIs(t, err, ErrChatNameReserved)
+	_, _, _, err = svc.AddUser("server")
+	assert.ErrorIs(t, err, ErrChatNameReserved)
+
+	_, _, _, err = svc.AddUser("administrator")
+	assert.NoError(t, err)
+}
+
+func TestAddUserConcurrent(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	svc := NewChatService(logger)
+
+	added := make(chan bool, 50)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, _, err := svc.AddUser("alice")
+			added <- err == nil
+		}()
+	}
+	wg.Wait()
+	close(added)
+
+	n := 0
+	for ok := range added {
+		if ok {
+			n++
+		}
+	}
+	assert.Equal(t, 1, n)
+}
+
+func TestChatSlowConsumerPolicies(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		policy       ChatSlowConsumerPolicy
+		queued       []string
+		dropped      float64
+		disconnected float64
+	}{
+		{policy: ChatSlowConsumerDropOldest, queued: []string{"m3", "m4"}, dropped: 2},
+		{policy: ChatSlowConsumerDropNewest, queued: []string{"m1", "m2"}, dropped: 2},
+		{policy: ChatSlowConsumerDisconnect, queued: []string{"m1", "m2"}, disconnected: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			registry := metrics.NewRegistry()
+			svc := NewChatService(logger,
+				WithChatChannelsBuffer(2),
+				WithChatSlowConsumerPolicy(tc.policy),
+				WithChatMetrics(registry),
+			)
+
+			senderId, _, _, _ := svc.AddUser("mike")
+			slowId, slowChan, _, _ := svc.AddUser("lara")
+
+			for _, msg := range []string{"m1", "m2", "m3", "m4"} {
+				svc.Broadcast(DefaultChatRoom, senderId, msg)
+			}
+
+			queued := []string{}
+			for msg := range slowChan {
+				queued = append(queued, msg)
+				if len(slowChan) == 0 && tc.policy != ChatSlowConsumerDisconnect {
+					break
+				}
+			}
+			assert.Equal(t, tc.queued, queued)
+
+			svcMetrics := svc.(*chatService).metrics
+			assert.Equal(t, tc.dropped, svcMetrics.messagesDropped.Value(string(tc.policy)))
+			assert.Equal(t, tc.disconnected, svcMetrics.slowDisconnected.Value())
+
+			// disconnected users stay listed until they are removed
+			assert.Equal(t, []string{"lara", "mike"}, svc.ListCurrentUsersNames())
+			room, ok := svc.RemoveUser(slowId)
+			assert.True(t, ok)
+			assert.Equal(t, DefaultChatRoom, room)
+		})
+	}
+}
+
+func TestChatStuckReader(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	svc := NewChatService(logger, WithChatChannelsBuffer(4))
+
+	senderId, _, _, _ := svc.AddUser("mike")
+	_, readerChan, _, _ := svc.AddUser("lara")
+	// john never reads its messages
+	svc.AddUser("john")
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range readerChan {
+			n++
+			if n == 1000 {
+				break
+			}
+		}
+		received <- n
+	}()
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			svc.Broadcast(DefaultChatRoom, senderId, fmt.Sprintf("[mike] message %d", i))
+			// let the reader keep up, it is only the stuck one that must not
+			for len(readerChan) == cap(readerChan) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	select {
+	case n := <-received:
+		assert.Equal(t, 1000, n)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "broadcasts blocked by the stuck reader")
+	}
+}
+
+func TestChatHistory(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	svc := NewChatService(logger, WithChatHistorySize(3))
+
+	historyMsgs := func(history []ChatMessage) []string {
+		msgs := []string{}
+		for _, m := range history {
+			msgs = append(msgs, m.Msg)
+		}
+		return msgs
+	}
+
+	mikeId, _, snapshot, _ := svc.AddUser("mike")
+	assert.Empty(t, snapshot.History)
+	laraId, laraChan, _, _ := svc.AddUser("lara")
+
+	before := time.Now()
+	for i := 1; i <= 5; i++ {
+		svc.Post(DefaultChatRoom, mikeId, fmt.Sprintf("[mike] m%d", i))
+	}
+	// announcements are not kept
+	svc.Broadcast(DefaultChatRoom, mikeId, "* john has entered the room")
+	assert.Len(t, laraChan, 6)
+
+	johnId, johnChan, snapshot, _ := svc.AddUser("john")
+	assert.Equal(t, []string{"[mike] m3", "[mike] m4", "[mike] m5"}, historyMsgs(snapshot.History))
+	for _, m := range snapshot.History {
+		assert.False(t, m.Time.Before(before))
+	}
+
+	// a message posted once the user joined is delivered live, not replayed
+	svc.Post(DefaultChatRoom, mikeId, "[mike] m6")
+	assert.Equal(t, "[mike] m6", <-johnChan)
+	assert.Equal(t, []string{"[mike] m3", "[mike] m4", "[mike] m5"}, historyMsgs(snapshot.History))
+
+	// rooms histories are separate, and forgotten once the room is empty
+	_, snapshot, err = svc.JoinRoom(laraId, "games")
+	assert.NoError(t, err)
+	assert.Empty(t, snapshot.History)
+	svc.Post("games", laraId, "[lara] anyone?")
+
+	_, snapshot, err = svc.JoinRoom(johnId, "games")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[lara] anyone?"}, historyMsgs(snapshot.History))
+
+	_, snapshot, err = svc.JoinRoom(laraId, DefaultChatRoom)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"[mike] m4", "[mike] m5", "[mike] m6"}, historyMsgs(snapshot.History))
+	_, _, err = svc.JoinRoom(johnId, DefaultChatRoom)
+	assert.NoError(t, err)
+
+	_, snapshot, err = svc.JoinRoom(johnId, "games")
+	assert.NoError(t, err)
+	assert.Empty(t, snapshot.History)
+
+	// the default room keeps its history
+	svc.RemoveUser(mikeId)
+	svc.RemoveUser(laraId)
+	_, _, snapshot, _ = svc.AddUser("mike")
+	assert.Len(t, snapshot.History, 3)
+}
+
+func TestChatHistoryDisabled(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+	svc := NewChatService(logger)
+
+	mikeId, _, _, _ := svc.AddUser("mike")
+	svc.Post(DefaultChatRoom, mikeId, "[mike] hello")
+
+	_, _, snapshot, err := svc.AddUser("lara")
+	assert.NoError(t, err)
+	assert.Empty(t, snapshot.History)
+}
@@ -3,19 +3,25 @@ package services
 import (
 	"errors"
 	"math"
+	"sort"
 	"sync"
 
+	"github.com/didil/protohackers/metrics"
+	"go.uber.org/zap"
 	"golang.org/x/exp/slices"
 )
 
 type SpeedDaemonService interface {
 	RegisterAsCamera(reqID string, road int, mile int, limit int) error
-	RegisterAsDispatcher(reqID string, roads []int) ([]chan *Ticket, error)
+	RegisterAsDispatcher(reqID string, roads []int) (chan bool, error)
 	GetCamera(reqID string) (*Camera, error)
 	GetDispatcher(reqID string) (*Dispatcher, error)
 	UnregisterClient(reqId string)
 	GetReqIdsForRoad(road int) []string
 	SavePlateObservation(plate string, timestamp, road, mile, limit int)
+	NextTicket(reqID string) *Ticket
+	MarkTicketSent(t *Ticket)
+	RequeueTicket(t *Ticket)
 }
 
 type speedDaemonService struct {
@@ -29,33 +35,116 @@ type speedDaemonService struct {
 	roads map[int][]string
 	// tickets: plate numbers that received tickets indexed by day
 	tickets map[int][]string
-	// plate observations indexed by plate number
-	plates map[string][]*Plate
-	// channel transmitting plate observations
-	platesC chan *Plate
-	// channels transmitting tickets, indexed by road number
-	ticketsChannels map[int]chan *Ticket
-	lock            *sync.Mutex
+	// plate observations sorted by timestamp, indexed by plate number and road
+	plates map[plateRoadKey][]*Plate
+	// tickets waiting for a dispatcher, indexed by road number
+	pendingTickets map[int][]*Ticket
+	// tickets routed to a dispatcher but not yet sent, indexed by req id
+	dispatcherTickets map[string][]*Ticket
+	// channels signalling dispatchers that tickets are ready, indexed by req id
+	dispatcherTicketsReady map[string]chan bool
+	// round robin position of the next dispatcher to receive a ticket, indexed by road number
+	nextDispatcher map[int]int
+	store          SpeedDaemonStore
+	ticketsIssued  *metrics.Counter
+	logger         *zap.Logger
+	lock           *sync.Mutex
 }
 
-func NewSpeedDaemonService() SpeedDaemonService {
+type SpeedDaemonServiceOpt func(*speedDaemonService) *speedDaemonService
+
+// WithSpeedDaemonStore persists observations and tickets to store, and restores the state it holds
+func WithSpeedDaemonStore(store SpeedDaemonStore) SpeedDaemonServiceOpt {
+	return func(s *speedDaemonService) *speedDaemonService {
+		s.store = store
+		return s
+	}
+}
+
+func WithSpeedDaemonLogger(logger *zap.Logger) SpeedDaemonServiceOpt {
+	return func(s *speedDaemonService) *speedDaemonService {
+		s.logger = logger
+		return s
+	}
+}
+
+// WithSpeedDaemonMetrics registers the service metrics in registry
+func WithSpeedDaemonMetrics(registry *metrics.Registry) SpeedDaemonServiceOpt {
+	return func(s *speedDaemonService) *speedDaemonService {
+		s.ticketsIssued = newTicketsIssuedCounter(registry)
+		return s
+	}
+}
+
+func newTicketsIssuedCounter(registry *metrics.Registry) *metrics.Counter {
+	return registry.NewCounter("protohackers_speed_daemon_tickets_issued_total", "Speed daemon tickets issued.")
+}
+
+func NewSpeedDaemonService(opts ...SpeedDaemonServiceOpt) SpeedDaemonService {
 	s := &speedDaemonService{
-		clients:         map[string]*Client{},
-		cameras:         map[string]*Camera{},
-		dispatchers:     map[string]*Dispatcher{},
-		roads:           map[int][]string{},
-		tickets:         map[int][]string{},
-		plates:          map[string][]*Plate{},
-		platesC:         make(chan *Plate, 1024),
-		ticketsChannels: map[int](chan *Ticket){},
-		lock:            &sync.Mutex{},
+		clients:                map[string]*Client{},
+		cameras:                map[string]*Camera{},
+		dispatchers:            map[string]*Dispatcher{},
+		roads:                  map[int][]string{},
+		tickets:                map[int][]string{},
+		plates:                 map[plateRoadKey][]*Plate{},
+		pendingTickets:         map[int][]*Ticket{},
+		dispatcherTickets:      map[string][]*Ticket{},
+		dispatcherTicketsReady: map[string]chan bool{},
+		nextDispatcher:         map[int]int{},
+		store:                  NewNopSpeedDaemonStore(),
+		ticketsIssued:          newTicketsIssuedCounter(metrics.NewRegistry()),
+		logger:                 zap.NewNop(),
+		lock:                   &sync.Mutex{},
+	}
+
+	for _, opt := range opts {
+		s = opt(s)
 	}
 
-	go s.processPlateObservations()
+	s.replay(s.store.Records())
 
 	return s
 }
 
+// replay restores the observations, ticket days and pending tickets from the store records
+func (s *speedDaemonService) replay(records []*SpeedDaemonRecord) {
+	for _, r := range records {
+		switch r.Type {
+		case SpeedDaemonRecordObservation:
+			o := r.Observation
+			s.insertPlateObservation(&Plate{o.Plate, o.Timestamp, o.Road, o.Mile, o.Limit})
+		case SpeedDaemonRecordTicket:
+			for _, d := range getDays(r.Ticket.Timestamp1, r.Ticket.Timestamp2) {
+				if !slices.Contains(s.tickets[d], r.Ticket.Plate) {
+					s.tickets[d] = append(s.tickets[d], r.Ticket.Plate)
+				}
+			}
+			s.routeTicket(r.Ticket)
+		case SpeedDaemonRecordTicketSent:
+			// a plate gets at most one ticket per day, plate and first timestamp identify the ticket
+			pending := s.pendingTickets[r.Ticket.Road]
+			i := slices.IndexFunc(pending, func(t *Ticket) bool {
+				return t.Plate == r.Ticket.Plate && t.Timestamp1 == r.Ticket.Timestamp1
+			})
+			if i >= 0 {
+				s.pendingTickets[r.Ticket.Road] = slices.Delete(pending, i, i+1)
+			}
+		}
+	}
+
+	if len(records) > 0 {
+		s.logger.Info("speed daemon state restored", zap.Int("records", len(records)))
+	}
+}
+
+func (s *speedDaemonService) appendRecord(r *SpeedDaemonRecord) {
+	err := s.store.Append(r)
+	if err != nil {
+		s.logger.Error("speed daemon store append error", zap.Error(err), zap.String("type", string(r.Type)))
+	}
+}
+
 type ClientType int
 
 const (
@@ -85,6 +174,11 @@ type Plate struct {
 	limit       int
 }
 
+type plateRoadKey struct {
+	plateNumber string
+	road        int
+}
+
 func (s *speedDaemonService) RegisterAsCamera(reqID string, road int, mile int, limit int) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -107,7 +201,8 @@ func (s *speedDaemonService) RegisterAsCamera(reqID string, road int, mile int,
 	return nil
 }
 
-func (s *speedDaemonService) RegisterAsDispatcher(reqID string, roads []int) ([]chan *Ticket, error) {
+// RegisterAsDispatcher returns a channel signalled whenever tickets are ready to be fetched with NextTicket
+func (s *speedDaemonService) RegisterAsDispatcher(reqID string, roads []int) (chan bool, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -120,23 +215,34 @@ func (s *speedDaemonService) RegisterAsDispatcher(reqID string, roads []int) ([]
 		clientType: ClientTypeDispatcher,
 	}
 
+	// a road listed twice would get the dispatcher twice in the road rotation
+	uniqueRoads := make([]int, 0, len(roads))
+	for _, road := range roads {
+		if !slices.Contains(uniqueRoads, road) {
+			uniqueRoads = append(uniqueRoads, road)
+		}
+	}
+	roads = uniqueRoads
+
 	s.dispatchers[reqID] = &Dispatcher{
 		roads: roads,
 	}
 
-	myTicketChans := []chan *Ticket{}
+	ticketsReady := make(chan bool, 1)
+	s.dispatcherTicketsReady[reqID] = ticketsReady
 
 	for _, road := range roads {
 		s.roads[road] = append(s.roads[road], reqID)
 
-		if s.ticketsChannels[road] == nil {
-			s.ticketsChannels[road] = make(chan *Ticket, 1024)
+		// deliver the tickets that were waiting for a dispatcher on this road
+		pending := s.pendingTickets[road]
+		delete(s.pendingTickets, road)
+		for _, t := range pending {
+			s.routeTicket(t)
 		}
-
-		myTicketChans = append(myTicketChans, s.ticketsChannels[road])
 	}
 
-	return myTicketChans, nil
+	return ticketsReady, nil
 }
 
 func (s *speedDaemonService) UnregisterClient(reqId string) {
@@ -150,16 +256,25 @@ func (s *speedDaemonService) UnregisterClient(reqId string) {
 	for roadIdx, reqIds := range s.roads {
 		s.roads[roadIdx] = deleteElemFromSlice(reqIds, reqId)
 	}
+
+	// tickets not sent yet go back to the queue
+	undelivered := s.dispatcherTickets[reqId]
+	delete(s.dispatcherTickets, reqId)
+	delete(s.dispatcherTicketsReady, reqId)
+
+	s.requeueTickets(undelivered)
 }
 
+// deleteElemFromSlice removes every occurrence of elem
 func deleteElemFromSlice(s []string, elem string) []string {
-	for i := 0; i < len(s); i++ {
+	for i := 0; i < len(s); {
 		if s[i] == elem {
 			s[i] = s[len(s)-1] // Copy last element to index i.
 			s[len(s)-1] = ""   // Erase last element (write zero value).
 			s = s[:len(s)-1]   // Truncate slice.
-			break
+			continue
 		}
+		i++
 	}
 
 	return s
@@ -224,56 +339,82 @@ func (s *speedDaemonService) SavePlateObservation(plateNumber string, timestamp,
 		limit,
 	}
 
-	s.plates[plateNumber] = append(s.plates[plateNumber], plate)
+	s.processPlateObservation(plate)
+}
+
+// processPlateObservation inserts the observation in time order and checks the speed
+// against the previous and next observations of the plate on the same road
+func (s *speedDaemonService) processPlateObservation(p *Plate) {
+	i, ok := s.insertPlateObservation(p)
+	if !ok {
+		return
+	}
+
+	s.appendRecord(&SpeedDaemonRecord{
+		Type:        SpeedDaemonRecordObservation,
+		Observation: &Observation{Plate: p.plateNumber, Timestamp: p.timestamp, Road: p.road, Mile: p.mile, Limit: p.limit},
+	})
 
-	s.platesC <- plate
+	observations := s.plates[plateRoadKey{plateNumber: p.plateNumber, road: p.road}]
+	if i > 0 {
+		s.checkSpeed(observations[i-1], p)
+	}
+	if i < len(observations)-1 {
+		s.checkSpeed(p, observations[i+1])
+	}
 }
 
-func (s *speedDaemonService) processPlateObservations() {
-	for p := range s.platesC {
-		s.lock.Lock()
-		for _, pl := range s.plates[p.plateNumber] {
-			if p.road == pl.road && pl.timestamp != p.timestamp {
-				var p1, p2 *Plate
-				if p.timestamp < pl.timestamp {
-					p1 = p
-					p2 = pl
-				} else {
-					p1 = pl
-					p2 = p
-				}
+// insertPlateObservation returns the index of the observation among the plate observations on the road,
+// false if the plate was already seen at that time
+func (s *speedDaemonService) insertPlateObservation(p *Plate) (int, bool) {
+	key := plateRoadKey{plateNumber: p.plateNumber, road: p.road}
+	observations := s.plates[key]
+
+	i := sort.Search(len(observations), func(i int) bool {
+		return observations[i].timestamp >= p.timestamp
+	})
+	if i < len(observations) && observations[i].timestamp == p.timestamp {
+		// a car can't be seen twice at the same time
+		return i, false
+	}
 
-				speed := calcSpeed(p1, p2)
-				if speed >= float64(p1.limit)+0.5 {
-					s.issueTickets(p1, p2)
-				}
-			}
-		}
+	s.plates[key] = slices.Insert(observations, i, p)
 
-		s.lock.Unlock()
+	return i, true
+}
+
+func (s *speedDaemonService) checkSpeed(p1, p2 *Plate) {
+	speed := calcSpeed(p1, p2)
+	if speed >= float64(p1.limit)+0.5 {
+		s.issueTickets(p1, p2)
 	}
 }
 
 type Ticket struct {
-	Plate      string
-	Road       int
-	Mile1      int
-	Timestamp1 int
-	Mile2      int
-	Timestamp2 int
-	Speed      int
+	Plate      string `json:"plate"`
+	Road       int    `json:"road"`
+	Mile1      int    `json:"mile1"`
+	Timestamp1 int    `json:"timestamp1"`
+	Mile2      int    `json:"mile2"`
+	Timestamp2 int    `json:"timestamp2"`
+	Speed      int    `json:"speed"`
 }
 
 func (s *speedDaemonService) issueTickets(p1, p2 *Plate) {
 	// for multiday, we issue a single ticket, and we add to tickets index for each of the days
 	days := getDays(p1.timestamp, p2.timestamp)
 
+	// a car can only receive one ticket per day
 	for _, d := range days {
-		if !slices.Contains(s.tickets[d], p1.plateNumber) {
-			s.tickets[d] = append(s.tickets[d], p1.plateNumber)
+		if slices.Contains(s.tickets[d], p1.plateNumber) {
+			return
 		}
 	}
 
+	for _, d := range days {
+		s.tickets[d] = append(s.tickets[d], p1.plateNumber)
+	}
+
 	t := &Ticket{
 		Plate:      p1.plateNumber,
 		Road:       p1.road,
@@ -284,16 +425,87 @@ func (s *speedDaemonService) issueTickets(p1, p2 *Plate) {
 		Speed:      int(calcSpeed(p1, p2) * 100),
 	}
 
-	if s.ticketsChannels[p1.road] == nil {
-		s.ticketsChannels[p1.road] = make(chan *Ticket, 1024)
+	s.appendRecord(&SpeedDaemonRecord{Type: SpeedDaemonRecordTicket, Ticket: t})
+	s.ticketsIssued.Inc()
+
+	s.routeTicket(t)
+}
+
+// routeTicket hands the ticket to the road dispatchers in turn, or queues it until one registers
+func (s *speedDaemonService) routeTicket(t *Ticket) {
+	reqIds := s.roads[t.Road]
+	if len(reqIds) == 0 {
+		s.pendingTickets[t.Road] = append(s.pendingTickets[t.Road], t)
+		return
+	}
+
+	next := s.nextDispatcher[t.Road] % len(reqIds)
+	s.nextDispatcher[t.Road] = next + 1
+
+	reqID := reqIds[next]
+	s.dispatcherTickets[reqID] = append(s.dispatcherTickets[reqID], t)
+
+	// non blocking: a signal may already be waiting for the dispatcher
+	select {
+	case s.dispatcherTicketsReady[reqID] <- true:
+	default:
+	}
+}
+
+// requeueTickets routes tickets again, keeping them ahead of the tickets already pending
+func (s *speedDaemonService) requeueTickets(tickets []*Ticket) {
+	requeued := map[int][]*Ticket{}
+
+	for _, t := range tickets {
+		if len(s.roads[t.Road]) == 0 {
+			requeued[t.Road] = append(requeued[t.Road], t)
+			continue
+		}
+
+		s.routeTicket(t)
+	}
+
+	for road, roadTickets := range requeued {
+		s.pendingTickets[road] = append(roadTickets, s.pendingTickets[road]...)
 	}
+}
+
+// NextTicket pops the next ticket to send to the dispatcher, nil if there is none
+func (s *speedDaemonService) NextTicket(reqID string) *Ticket {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tickets := s.dispatcherTickets[reqID]
+	if len(tickets) == 0 {
+		return nil
+	}
+
+	t := tickets[0]
+	s.dispatcherTickets[reqID] = tickets[1:]
+
+	return t
+}
+
+// MarkTicketSent records that the ticket was written to a dispatcher, it is no longer restored as pending
+func (s *speedDaemonService) MarkTicketSent(t *Ticket) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.appendRecord(&SpeedDaemonRecord{Type: SpeedDaemonRecordTicketSent, Ticket: t})
+}
+
+// RequeueTicket puts back a ticket that couldn't be sent to a dispatcher
+func (s *speedDaemonService) RequeueTicket(t *Ticket) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
-	s.ticketsChannels[p1.road] <- t
+	// the ticket is still pending in the store, it was not marked as sent
+	s.requeueTickets([]*Ticket{t})
 }
 
-// speed in mph
+// speed in mph, cars can travel in both directions
 func calcSpeed(p1, p2 *Plate) float64 {
-	return (float64(p2.mile) - float64(p1.mile)) * 3600 / (float64(p2.timestamp) - float64(p1.timestamp))
+	return math.Abs(float64(p2.mile)-float64(p1.mile)) * 3600 / (float64(p2.timestamp) - float64(p1.timestamp))
 }
 
 // get days (start of day) between two timestamps
@@ -1,10 +1,15 @@
 package services
 
 import (
+	"fmt"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slices"
 )
 
 func TestRegisterAsCamera(t *testing.T) {
@@ -71,6 +76,14 @@ func TestCalcSpeed(t *testing.T) {
 	}
 
 	assert.Equal(t, float64(80), calcSpeed(p1, p2))
+
+	// cars driving toward lower miles have a positive speed too
+	p3 := &Plate{
+		mile:      7,
+		timestamp: 190,
+	}
+
+	assert.Equal(t, float64(160), calcSpeed(p2, p3))
 }
 
 func TestGetDays(t *testing.T) {
@@ -81,3 +94,435 @@ func TestGetDays(t *testing.T) {
 	assert.Equal(t, []int{19434, 19435, 19436, 19437}, getDays(t1, t2))
 	assert.Equal(t, []int{19437}, getDays(t2, t3))
 }
+
+func TestIssueTicketsOncePerDay(t *testing.T) {
+	day := 86400
+
+	tests := []struct {
+		name           string
+		ticketedDays   []int
+		t1             int
+		t2             int
+		expectedIssued bool
+		expectedDays   []int
+	}{
+		{
+			name:           "no previous ticket",
+			ticketedDays:   []int{},
+			t1:             10*day + 100,
+			t2:             10*day + 200,
+			expectedIssued: true,
+			expectedDays:   []int{10},
+		},
+		{
+			name:           "already ticketed same day",
+			ticketedDays:   []int{10},
+			t1:             10*day + 100,
+			t2:             10*day + 200,
+			expectedIssued: false,
+			expectedDays:   []int{10},
+		},
+		{
+			name:           "ticketed on another day",
+			ticketedDays:   []int{9},
+			t1:             10*day + 100,
+			t2:             10*day + 200,
+			expectedIssued: true,
+			expectedDays:   []int{9, 10},
+		},
+		{
+			name:           "multiday ticket",
+			ticketedDays:   []int{},
+			t1:             10*day + 100,
+			t2:             12*day + 200,
+			expectedIssued: true,
+			expectedDays:   []int{10, 11, 12},
+		},
+		{
+			name:           "multiday overlapping ticketed first day",
+			ticketedDays:   []int{10},
+			t1:             10*day + 100,
+			t2:             11*day + 200,
+			expectedIssued: false,
+			expectedDays:   []int{10},
+		},
+		{
+			name:           "multiday overlapping ticketed last day",
+			ticketedDays:   []int{12},
+			t1:             10*day + 100,
+			t2:             12*day + 200,
+			expectedIssued: false,
+			expectedDays:   []int{12},
+		},
+		{
+			name:           "multiday overlapping ticketed middle day",
+			ticketedDays:   []int{11},
+			t1:             10*day + 100,
+			t2:             12*day + 200,
+			expectedIssued: false,
+			expectedDays:   []int{11},
+		},
+		{
+			name:           "multiday adjacent to ticketed days",
+			ticketedDays:   []int{9, 13},
+			t1:             10*day + 100,
+			t2:             12*day + 200,
+			expectedIssued: true,
+			expectedDays:   []int{9, 10, 11, 12, 13},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSpeedDaemonService().(*speedDaemonService)
+
+			for _, d := range tt.ticketedDays {
+				s.tickets[d] = []string{"UN1X"}
+			}
+
+			p1 := &Plate{plateNumber: "UN1X", timestamp: tt.t1, road: 66, mile: 0, limit: 60}
+			p2 := &Plate{plateNumber: "UN1X", timestamp: tt.t2, road: 66, mile: 1000, limit: 60}
+
+			s.issueTickets(p1, p2)
+
+			if tt.expectedIssued {
+				assert.Len(t, s.pendingTickets[66], 1)
+				assert.Equal(t, float64(1), s.ticketsIssued.Value())
+			} else {
+				assert.Len(t, s.pendingTickets[66], 0)
+				assert.Equal(t, float64(0), s.ticketsIssued.Value())
+			}
+
+			days := []int{}
+			for d, plates := range s.tickets {
+				if slices.Contains(plates, "UN1X") {
+					days = append(days, d)
+				}
+			}
+			sort.Ints(days)
+			assert.Equal(t, tt.expectedDays, days)
+		})
+	}
+}
+
+func TestPendingTicketsDeliveredToFirstDispatcher(t *testing.T) {
+	s := NewSpeedDaemonService().(*speedDaemonService)
+
+	t1 := &Ticket{Plate: "UN1X", Road: 66, Timestamp1: 0, Timestamp2: 45}
+	t2 := &Ticket{Plate: "RE05BKG", Road: 66, Timestamp1: 100, Timestamp2: 145}
+	t3 := &Ticket{Plate: "ABC", Road: 70, Timestamp1: 100, Timestamp2: 145}
+
+	s.lock.Lock()
+	s.routeTicket(t1)
+	s.routeTicket(t2)
+	s.routeTicket(t3)
+	s.lock.Unlock()
+
+	assert.Equal(t, []*Ticket{t1, t2}, s.pendingTickets[66])
+	assert.Equal(t, []*Ticket{t3}, s.pendingTickets[70])
+
+	reqID1 := uuid.New().String()
+	ticketsReady, err := s.RegisterAsDispatcher(reqID1, []int{66})
+	assert.NoError(t, err)
+
+	assert.True(t, <-ticketsReady)
+	assert.Equal(t, t1, s.NextTicket(reqID1))
+	assert.Equal(t, t2, s.NextTicket(reqID1))
+	assert.Nil(t, s.NextTicket(reqID1))
+
+	// road 70 still waiting for a dispatcher
+	assert.Equal(t, []*Ticket{t3}, s.pendingTickets[70])
+
+	// second dispatcher on the road gets nothing pending
+	reqID2 := uuid.New().String()
+	_, err = s.RegisterAsDispatcher(reqID2, []int{66})
+	assert.NoError(t, err)
+	assert.Nil(t, s.NextTicket(reqID2))
+}
+
+func TestRequeueTicket(t *testing.T) {
+	s := NewSpeedDaemonService().(*speedDaemonService)
+
+	t1 := &Ticket{Plate: "UN1X", Road: 66, Timestamp1: 0, Timestamp2: 45}
+	t2 := &Ticket{Plate: "RE05BKG", Road: 66, Timestamp1: 100, Timestamp2: 145}
+	t3 := &Ticket{Plate: "ABC", Road: 66, Timestamp1: 200, Timestamp2: 245}
+
+	reqID1 := uuid.New().String()
+	_, err := s.RegisterAsDispatcher(reqID1, []int{66})
+	assert.NoError(t, err)
+
+	s.lock.Lock()
+	s.routeTicket(t1)
+	s.routeTicket(t2)
+	s.lock.Unlock()
+
+	// dispatcher disconnects while writing t1
+	assert.Equal(t, t1, s.NextTicket(reqID1))
+	s.UnregisterClient(reqID1)
+	s.RequeueTicket(t1)
+
+	s.lock.Lock()
+	s.routeTicket(t3)
+	s.lock.Unlock()
+
+	assert.Equal(t, []*Ticket{t1, t2, t3}, s.pendingTickets[66])
+
+	reqID2 := uuid.New().String()
+	_, err = s.RegisterAsDispatcher(reqID2, []int{66})
+	assert.NoError(t, err)
+
+	assert.Equal(t, t1, s.NextTicket(reqID2))
+	assert.Equal(t, t2, s.NextTicket(reqID2))
+	assert.Equal(t, t3, s.NextTicket(reqID2))
+	assert.Nil(t, s.NextTicket(reqID2))
+}
+
+func TestIssueTicketsNeverBlocks(t *testing.T) {
+	s := NewSpeedDaemonService().(*speedDaemonService)
+
+	day := 86400
+	for i := 0; i < 5000; i++ {
+		p1 := &Plate{plateNumber: uuid.New().String(), timestamp: 10 * day, road: 66, mile: 0, limit: 60}
+		p2 := &Plate{plateNumber: p1.plateNumber, timestamp: 10*day + 60, road: 66, mile: 10, limit: 60}
+		s.issueTickets(p1, p2)
+	}
+
+	assert.Len(t, s.pendingTickets[66], 5000)
+}
+
+func TestRoundRobinDispatchers(t *testing.T) {
+	s := NewSpeedDaemonService().(*speedDaemonService)
+
+	reqIDs := []string{uuid.New().String(), uuid.New().String(), uuid.New().String()}
+	for _, reqID := range reqIDs {
+		_, err := s.RegisterAsDispatcher(reqID, []int{66})
+		assert.NoError(t, err)
+	}
+
+	tickets := []*Ticket{}
+	s.lock.Lock()
+	for i := 0; i < 9; i++ {
+		ticket := &Ticket{Plate: fmt.Sprintf("P%d", i), Road: 66}
+		tickets = append(tickets, ticket)
+		s.routeTicket(ticket)
+	}
+	s.lock.Unlock()
+
+	received := map[string][]*Ticket{}
+	for _, reqID := range reqIDs {
+		for ticket := s.NextTicket(reqID); ticket != nil; ticket = s.NextTicket(reqID) {
+			received[reqID] = append(received[reqID], ticket)
+		}
+	}
+
+	for i, reqID := range reqIDs {
+		assert.Equal(t, []*Ticket{tickets[i], tickets[i+3], tickets[i+6]}, received[reqID])
+	}
+}
+
+func TestRoundRobinDispatcherLeaves(t *testing.T) {
+	s := NewSpeedDaemonService().(*speedDaemonService)
+
+	reqID1 := uuid.New().String()
+	reqID2 := uuid.New().String()
+	_, err := s.RegisterAsDispatcher(reqID1, []int{66})
+	assert.NoError(t, err)
+	_, err = s.RegisterAsDispatcher(reqID2, []int{66, 70})
+	assert.NoError(t, err)
+
+	t1 := &Ticket{Plate: "P1", Road: 66}
+	t2 := &Ticket{Plate: "P2", Road: 66}
+	t3 := &Ticket{Plate: "P3", Road: 66}
+	t4 := &Ticket{Plate: "P4", Road: 66}
+
+	s.lock.Lock()
+	s.routeTicket(t1)
+	s.routeTicket(t2)
+	s.routeTicket(t3)
+	s.routeTicket(t4)
+	s.lock.Unlock()
+
+	// dispatcher 2 leaves before sending anything, its tickets go to dispatcher 1
+	s.UnregisterClient(reqID2)
+
+	received := []*Ticket{}
+	for ticket := s.NextTicket(reqID1); ticket != nil; ticket = s.NextTicket(reqID1) {
+		received = append(received, ticket)
+	}
+
+	assert.ElementsMatch(t, []*Ticket{t1, t2, t3, t4}, received)
+	assert.Empty(t, s.pendingTickets[66])
+}
+
+func TestDispatcherDuplicateRoads(t *testing.T) {
+	s := NewSpeedDaemonService().(*speedDaemonService)
+
+	reqID1 := uuid.New().String()
+	_, err := s.RegisterAsDispatcher(reqID1, []int{66, 66})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{reqID1}, s.GetReqIdsForRoad(66))
+
+	dispatcher, err := s.GetDispatcher(reqID1)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{66}, dispatcher.roads)
+
+	t1 := &Ticket{Plate: "P1", Road: 66}
+	t2 := &Ticket{Plate: "P2", Road: 66}
+
+	s.lock.Lock()
+	s.routeTicket(t1)
+	s.lock.Unlock()
+
+	// the unsent ticket goes back to pending, and no ticket is routed to the gone dispatcher
+	s.UnregisterClient(reqID1)
+	assert.Empty(t, s.GetReqIdsForRoad(66))
+
+	s.lock.Lock()
+	s.routeTicket(t2)
+	s.lock.Unlock()
+
+	_, ok := s.dispatcherTickets[reqID1]
+	assert.False(t, ok)
+	assert.Equal(t, []*Ticket{t1, t2}, s.pendingTickets[66])
+
+	// the tickets wait for the next dispatcher of the road
+	reqID2 := uuid.New().String()
+	_, err = s.RegisterAsDispatcher(reqID2, []int{66})
+	assert.NoError(t, err)
+	assert.Equal(t, t1, s.NextTicket(reqID2))
+	assert.Equal(t, t2, s.NextTicket(reqID2))
+}
+
+func TestDeleteElemFromSlice(t *testing.T) {
+	assert.Equal(t, []string{"c", "b"}, deleteElemFromSlice([]string{"a", "b", "a", "c", "a"}, "a"))
+	assert.Equal(t, []string{"b"}, deleteElemFromSlice([]string{"b"}, "a"))
+	assert.Empty(t, deleteElemFromSlice([]string{"a", "a"}, "a"))
+}
+
+func TestDispatchersReceiveEachTicketOnce(t *testing.T) {
+	s := NewSpeedDaemonService().(*speedDaemonService)
+
+	numDispatchers := 5
+	numTickets := 1000
+
+	received := make(chan *Ticket, numTickets)
+	done := make(chan bool)
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < numDispatchers; i++ {
+		reqID := uuid.New().String()
+		ticketsReady, err := s.RegisterAsDispatcher(reqID, []int{66})
+		assert.NoError(t, err)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticketsReady:
+					for ticket := s.NextTicket(reqID); ticket != nil; ticket = s.NextTicket(reqID) {
+						received <- ticket
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < numTickets; i++ {
+		s.lock.Lock()
+		s.routeTicket(&Ticket{Plate: fmt.Sprintf("P%d", i), Road: 66})
+		s.lock.Unlock()
+	}
+
+	plates := map[string]int{}
+	for i := 0; i < numTickets; i++ {
+		select {
+		case ticket := <-received:
+			plates[ticket.Plate]++
+		case <-time.After(time.Second):
+			t.Fatalf("only received %d tickets", i)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	assert.Len(t, plates, numTickets)
+	for _, count := range plates {
+		assert.Equal(t, 1, count)
+	}
+	assert.Empty(t, received)
+}
+
+func TestSavePlateObservationNearestNeighbours(t *testing.T) {
+	s := NewSpeedDaemonService().(*speedDaemonService)
+
+	// 50 miles in 3000s is 60 mph, then 50 miles in 600s is 300 mph
+	s.SavePlateObservation("UN1X", 0, 66, 0, 60)
+	s.SavePlateObservation("UN1X", 3000, 66, 50, 60)
+	s.SavePlateObservation("UN1X", 3600, 66, 100, 60)
+
+	// non adjacent observations (0 -> 3600, 100 mph) are not compared
+	assert.Equal(t, []*Ticket{
+		{Plate: "UN1X", Road: 66, Mile1: 50, Timestamp1: 3000, Mile2: 100, Timestamp2: 3600, Speed: 30000},
+	}, s.pendingTickets[66])
+}
+
+func TestSavePlateObservationOutOfOrder(t *testing.T) {
+	s := NewSpeedDaemonService().(*speedDaemonService)
+
+	s.SavePlateObservation("UN1X", 3600, 66, 100, 60)
+	s.SavePlateObservation("UN1X", 3000, 66, 50, 60)
+	s.SavePlateObservation("UN1X", 0, 66, 0, 60)
+
+	assert.Equal(t, []*Ticket{
+		{Plate: "UN1X", Road: 66, Mile1: 50, Timestamp1: 3000, Mile2: 100, Timestamp2: 3600, Speed: 30000},
+	}, s.pendingTickets[66])
+
+	timestamps := []int{}
+	for _, p := range s.plates[plateRoadKey{plateNumber: "UN1X", road: 66}] {
+		timestamps = append(timestamps, p.timestamp)
+	}
+	assert.Equal(t, []int{0, 3000, 3600}, timestamps)
+}
+
+func TestSavePlateObservationRoadsAndDirections(t *testing.T) {
+	s := NewSpeedDaemonService().(*speedDaemonService)
+
+	// same plate on different roads is never compared
+	s.SavePlateObservation("UN1X", 0, 66, 0, 60)
+	s.SavePlateObservation("UN1X", 60, 70, 10, 60)
+	assert.Empty(t, s.pendingTickets)
+
+	// duplicate observation is ignored
+	s.SavePlateObservation("UN1X", 0, 66, 5, 60)
+	assert.Empty(t, s.pendingTickets)
+
+	// driving towards lower miles
+	s.SavePlateObservation("RE05BKG", 0, 80, 10, 60)
+	s.SavePlateObservation("RE05BKG", 360, 80, 0, 60)
+
+	assert.Equal(t, []*Ticket{
+		{Plate: "RE05BKG", Road: 80, Mile1: 10, Timestamp1: 0, Mile2: 0, Timestamp2: 360, Speed: 10000},
+	}, s.pendingTickets[80])
+}
+
+func BenchmarkSavePlateObservation(b *testing.B) {
+	numObservations := 100000
+	numPlates := 1000
+	numCameras := 10
+
+	for n := 0; n < b.N; n++ {
+		s := NewSpeedDaemonService()
+
+		for i := 0; i < numObservations; i++ {
+			plate := fmt.Sprintf("P%d", i%numPlates)
+			camera := (i / numPlates) % numCameras
+			// every pass over the cameras happens on a later day
+			timestamp := (i/numPlates)*60 + (i/(numPlates*numCameras))*86400
+			s.SavePlateObservation(plate, timestamp, 66, camera, 60)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SpeedDaemonStore persists the speed daemon state as an ordered log of records
+type SpeedDaemonStore interface {
+	// Records returns the records appended before the store was opened, in order
+	Records() []*SpeedDaemonRecord
+	Append(r *SpeedDaemonRecord) error
+	Close() error
+}
+
+type SpeedDaemonRecordType string
+
+const (
+	// plate observation saved
+	SpeedDaemonRecordObservation SpeedDaemonRecordType = "observation"
+	// ticket issued
+	SpeedDaemonRecordTicket SpeedDaemonRecordType = "ticket"
+	// ticket written to a dispatcher
+	SpeedDaemonRecordTicketSent SpeedDaemonRecordType = "ticket_sent"
+)
+
+type SpeedDaemonRecord struct {
+	Type        SpeedDaemonRecordType `json:"type"`
+	Observation *Observation          `json:"observation,omitempty"`
+	Ticket      *Ticket               `json:"ticket,omitempty"`
+}
+
+type Observation struct {
+	Plate     string `json:"plate"`
+	Timestamp int    `json:"timestamp"`
+	Road      int    `json:"road"`
+	Mile      int    `json:"mile"`
+	Limit     int    `json:"limit"`
+}
+
+type nopSpeedDaemonStore struct{}
+
+// NewNopSpeedDaemonStore returns a store that keeps nothing, the state only lives in the service
+func NewNopSpeedDaemonStore() SpeedDaemonStore {
+	return &nopSpeedDaemonStore{}
+}
+
+func (*nopSpeedDaemonStore) Records() []*SpeedDaemonRecord     { return nil }
+func (*nopSpeedDaemonStore) Append(r *SpeedDaemonRecord) error { return nil }
+func (*nopSpeedDaemonStore) Close() error                      { return nil }
+
+type fileSpeedDaemonStore struct {
+	file    *os.File
+	records []*SpeedDaemonRecord
+	lock    *sync.Mutex
+}
+
+// NewFileSpeedDaemonStore opens the append-only log at path, one JSON record per line
+func NewFileSpeedDaemonStore(path string) (SpeedDaemonStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open speed daemon store")
+	}
+
+	records, validLen, err := readSpeedDaemonRecords(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// drop a last record partially written before a crash
+	err = file.Truncate(validLen)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to truncate speed daemon store")
+	}
+	_, err = file.Seek(validLen, 0)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to seek speed daemon store")
+	}
+
+	return &fileSpeedDaemonStore{
+		file:    file,
+		records: records,
+		lock:    &sync.Mutex{},
+	}, nil
+}
+
+func readSpeedDaemonRecords(file *os.File) ([]*SpeedDaemonRecord, int64, error) {
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to read speed daemon store")
+	}
+
+	records := []*SpeedDaemonRecord{}
+	var validLen int64
+
+	for lineNum := 1; ; lineNum++ {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			// no newline: empty or partially written line
+			break
+		}
+
+		r := &SpeedDaemonRecord{}
+		err := json.Unmarshal(data[:i], r)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "invalid speed daemon store record line %d", lineNum)
+		}
+		records = append(records, r)
+
+		data = data[i+1:]
+		validLen += int64(i + 1)
+	}
+
+	return records, validLen, nil
+}
+
+func (s *fileSpeedDaemonStore) Records() []*SpeedDaemonRecord {
+	return s.records
+}
+
+func (s *fileSpeedDaemonStore) Append(r *SpeedDaemonRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal speed daemon record")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err = s.file.Write(append(data, '\n'))
+	if err != nil {
+		return errors.Wrapf(err, "failed to append speed daemon record")
+	}
+
+	return nil
+}
+
+func (s *fileSpeedDaemonStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.file.Close()
+}
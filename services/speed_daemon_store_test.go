@@ -0,0 +1,174 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSpeedDaemonStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "speed_daemon.log")
+
+	store, err := NewFileSpeedDaemonStore(path)
+	assert.NoError(t, err)
+	assert.Empty(t, store.Records())
+
+	r1 := &SpeedDaemonRecord{Type: SpeedDaemonRecordObservation, Observation: &Observation{Plate: "UN1X", Timestamp: 0, Road: 123, Mile: 8, Limit: 60}}
+	r2 := &SpeedDaemonRecord{Type: SpeedDaemonRecordTicket, Ticket: &Ticket{Plate: "UN1X", Road: 123, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45, Speed: 8000}}
+
+	assert.NoError(t, store.Append(r1))
+	assert.NoError(t, store.Append(r2))
+	assert.NoError(t, store.Close())
+
+	store, err = NewFileSpeedDaemonStore(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []*SpeedDaemonRecord{r1, r2}, store.Records())
+	assert.NoError(t, store.Close())
+}
+
+func TestFileSpeedDaemonStorePartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "speed_daemon.log")
+
+	data := `{"type":"observation","observation":{"plate":"UN1X","timestamp":0,"road":123,"mile":8,"limit":60}}
+{"type":"observ`
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+
+	store, err := NewFileSpeedDaemonStore(path)
+	assert.NoError(t, err)
+	assert.Len(t, store.Records(), 1)
+
+	r := &SpeedDaemonRecord{Type: SpeedDaemonRecordObservation, Observation: &Observation{Plate: "UN1X", Timestamp: 45, Road: 123, Mile: 9, Limit: 60}}
+	assert.NoError(t, store.Append(r))
+	assert.NoError(t, store.Close())
+
+	// the partial record is dropped and the log stays valid
+	store, err = NewFileSpeedDaemonStore(path)
+	assert.NoError(t, err)
+	assert.Len(t, store.Records(), 2)
+	assert.Equal(t, r, store.Records()[1])
+	assert.NoError(t, store.Close())
+}
+
+func TestFileSpeedDaemonStoreCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "speed_daemon.log")
+
+	assert.NoError(t, os.WriteFile(path, []byte("not json\n{}\n"), 0644))
+
+	_, err := NewFileSpeedDaemonStore(path)
+	assert.ErrorContains(t, err, "invalid speed daemon store record line 1")
+}
+
+func TestSpeedDaemonServiceRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "speed_daemon.log")
+
+	store, err := NewFileSpeedDaemonStore(path)
+	assert.NoError(t, err)
+
+	s := NewSpeedDaemonService(WithSpeedDaemonStore(store))
+
+	// two tickets on road 123
+	s.SavePlateObservation("UN1X", 0, 123, 8, 60)
+	s.SavePlateObservation("UN1X", 45, 123, 9, 60)
+	s.SavePlateObservation("RE05BKG", 0, 123, 8, 60)
+	s.SavePlateObservation("RE05BKG", 45, 123, 9, 60)
+
+	// the first one is sent to a dispatcher
+	reqID := uuid.New().String()
+	_, err = s.RegisterAsDispatcher(reqID, []int{123})
+	assert.NoError(t, err)
+	sent := s.NextTicket(reqID)
+	assert.Equal(t, "UN1X", sent.Plate)
+	s.MarkTicketSent(sent)
+	s.UnregisterClient(reqID)
+
+	assert.NoError(t, store.Close())
+
+	// restart
+	store, err = NewFileSpeedDaemonStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	s = NewSpeedDaemonService(WithSpeedDaemonStore(store))
+
+	// the ticket not sent is still pending
+	assert.Equal(t, []*Ticket{
+		{Plate: "RE05BKG", Road: 123, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45, Speed: 8000},
+	}, s.(*speedDaemonService).pendingTickets[123])
+
+	// UN1X was already ticketed on day 0
+	s.SavePlateObservation("UN1X", 90, 123, 10, 60)
+
+	// observations were restored: 10 -> 20 between 1000 and 1090 is a new ticket on day 1
+	s.SavePlateObservation("UN1X", 86400+1000, 123, 10, 60)
+	s.SavePlateObservation("UN1X", 86400+1090, 123, 20, 60)
+
+	reqID = uuid.New().String()
+	_, err = s.RegisterAsDispatcher(reqID, []int{123})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "RE05BKG", s.NextTicket(reqID).Plate)
+	assert.Equal(t, &Ticket{Plate: "UN1X", Road: 123, Mile1: 10, Timestamp1: 86400 + 1000, Mile2: 20, Timestamp2: 86400 + 1090, Speed: 40000}, s.NextTicket(reqID))
+	assert.Nil(t, s.NextTicket(reqID))
+}
+
+func TestSpeedDaemonServiceRestoreRequeued(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "speed_daemon.log")
+
+	store, err := NewFileSpeedDaemonStore(path)
+	assert.NoError(t, err)
+
+	s := NewSpeedDaemonService(WithSpeedDaemonStore(store))
+
+	s.SavePlateObservation("UN1X", 0, 123, 8, 60)
+	s.SavePlateObservation("UN1X", 45, 123, 9, 60)
+
+	// sending fails, ticket is given back
+	reqID := uuid.New().String()
+	_, err = s.RegisterAsDispatcher(reqID, []int{123})
+	assert.NoError(t, err)
+	ticket := s.NextTicket(reqID)
+	s.UnregisterClient(reqID)
+	s.RequeueTicket(ticket)
+
+	assert.NoError(t, store.Close())
+
+	store, err = NewFileSpeedDaemonStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	s = NewSpeedDaemonService(WithSpeedDaemonStore(store))
+
+	assert.Equal(t, []*Ticket{ticket}, s.(*speedDaemonService).pendingTickets[123])
+}
+
+func TestSpeedDaemonServiceRestoreUnsent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "speed_daemon.log")
+
+	store, err := NewFileSpeedDaemonStore(path)
+	assert.NoError(t, err)
+
+	s := NewSpeedDaemonService(WithSpeedDaemonStore(store))
+
+	s.SavePlateObservation("UN1X", 0, 123, 8, 60)
+	s.SavePlateObservation("UN1X", 45, 123, 9, 60)
+
+	// the ticket is taken by a dispatcher, but the server stops before writing it
+	reqID := uuid.New().String()
+	_, err = s.RegisterAsDispatcher(reqID, []int{123})
+	assert.NoError(t, err)
+	ticket := s.NextTicket(reqID)
+	assert.NotNil(t, ticket)
+
+	assert.NoError(t, store.Close())
+
+	store, err = NewFileSpeedDaemonStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	s = NewSpeedDaemonService(WithSpeedDaemonStore(store))
+
+	assert.Equal(t, []*Ticket{ticket}, s.(*speedDaemonService).pendingTickets[123])
+}
@@ -7,6 +7,8 @@ import (
 type UnusualDbService interface {
 	Set(key string, value string)
 	Get(key string) string
+	// Len returns the number of keys stored
+	Len() int
 }
 
 type unusualDbService struct {
@@ -42,3 +44,10 @@ func (s *unusualDbService) Get(key string) string {
 
 	return s.db[key]
 }
+
+func (s *unusualDbService) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.db)
+}
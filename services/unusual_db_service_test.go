@@ -20,4 +20,6 @@ func TestUnusualDbService(t *testing.T) {
 
 	svc.Set("my-other-key", "456=30")
 	assert.Equal(t, "456=30", svc.Get("my-other-key"))
+
+	assert.Equal(t, 3, svc.Len())
 }
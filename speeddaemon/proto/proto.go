@@ -0,0 +1,388 @@
+// Package proto implements the binary wire format of the Speed Daemon protocol.
+//
+// All integers are big endian, strings are a 1 byte length followed by the bytes.
+package proto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+type MsgType byte
+
+const (
+	// Server Messages
+	MsgTypeError     MsgType = 0x10
+	MsgTypeTicket    MsgType = 0x21
+	MsgTypeHeartbeat MsgType = 0x41
+
+	// Client Messages
+	MsgTypePlate         MsgType = 0x20
+	MsgTypeWantHeartbeat MsgType = 0x40
+	MsgTypeIAmCamera     MsgType = 0x80
+	MsgTypeIAmDispatcher MsgType = 0x81
+)
+
+func (t MsgType) String() string {
+	switch t {
+	case MsgTypeError:
+		return "Error"
+	case MsgTypeTicket:
+		return "Ticket"
+	case MsgTypeHeartbeat:
+		return "Heartbeat"
+	case MsgTypePlate:
+		return "Plate"
+	case MsgTypeWantHeartbeat:
+		return "WantHeartbeat"
+	case MsgTypeIAmCamera:
+		return "IAmCamera"
+	case MsgTypeIAmDispatcher:
+		return "IAmDispatcher"
+	default:
+		return fmt.Sprintf("0x%02x", byte(t))
+	}
+}
+
+var (
+	ErrUnknownMsgType = errors.New("unknown message type")
+	ErrTruncated      = errors.New("message truncated")
+	ErrStringTooLong  = errors.New("string longer than 255 bytes")
+	ErrTooManyRoads   = errors.New("more than 255 roads")
+)
+
+// Message is any of the seven protocol messages
+type Message interface {
+	Type() MsgType
+	// Encode writes the message type followed by the message fields
+	Encode(w *bufio.Writer) error
+}
+
+type Error struct {
+	Msg string
+}
+
+type Plate struct {
+	Plate     string
+	Timestamp uint32
+}
+
+type Ticket struct {
+	Plate      string
+	Road       uint16
+	Mile1      uint16
+	Timestamp1 uint32
+	Mile2      uint16
+	Timestamp2 uint32
+	// Speed in 100x miles per hour
+	Speed uint16
+}
+
+type WantHeartbeat struct {
+	// Interval in deciseconds, 0 means no heartbeat
+	Interval uint32
+}
+
+type Heartbeat struct{}
+
+type IAmCamera struct {
+	Road  uint16
+	Mile  uint16
+	Limit uint16
+}
+
+type IAmDispatcher struct {
+	Roads []uint16
+}
+
+func (*Error) Type() MsgType         { return MsgTypeError }
+func (*Plate) Type() MsgType         { return MsgTypePlate }
+func (*Ticket) Type() MsgType        { return MsgTypeTicket }
+func (*WantHeartbeat) Type() MsgType { return MsgTypeWantHeartbeat }
+func (*Heartbeat) Type() MsgType     { return MsgTypeHeartbeat }
+func (*IAmCamera) Type() MsgType     { return MsgTypeIAmCamera }
+func (*IAmDispatcher) Type() MsgType { return MsgTypeIAmDispatcher }
+
+// Decode reads the next message. It returns io.EOF if the stream ends cleanly between messages
+func Decode(r *bufio.Reader) (Message, error) {
+	msgTypeData, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch msgType := MsgType(msgTypeData); msgType {
+	case MsgTypeError:
+		return DecodeError(r)
+	case MsgTypePlate:
+		return DecodePlate(r)
+	case MsgTypeTicket:
+		return DecodeTicket(r)
+	case MsgTypeWantHeartbeat:
+		return DecodeWantHeartbeat(r)
+	case MsgTypeHeartbeat:
+		return &Heartbeat{}, nil
+	case MsgTypeIAmCamera:
+		return DecodeIAmCamera(r)
+	case MsgTypeIAmDispatcher:
+		return DecodeIAmDispatcher(r)
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnknownMsgType, msgType)
+	}
+}
+
+// DecodeError reads the fields of an Error message, the message type already consumed
+func DecodeError(r *bufio.Reader) (*Error, error) {
+	d := &decoder{r: r, msgType: MsgTypeError}
+	m := &Error{Msg: d.str()}
+
+	return m, d.err
+}
+
+// DecodePlate reads the fields of a Plate message, the message type already consumed
+func DecodePlate(r *bufio.Reader) (*Plate, error) {
+	d := &decoder{r: r, msgType: MsgTypePlate}
+	m := &Plate{
+		Plate:     d.str(),
+		Timestamp: d.u32(),
+	}
+
+	return m, d.err
+}
+
+// DecodeTicket reads the fields of a Ticket message, the message type already consumed
+func DecodeTicket(r *bufio.Reader) (*Ticket, error) {
+	d := &decoder{r: r, msgType: MsgTypeTicket}
+	m := &Ticket{
+		Plate:      d.str(),
+		Road:       d.u16(),
+		Mile1:      d.u16(),
+		Timestamp1: d.u32(),
+		Mile2:      d.u16(),
+		Timestamp2: d.u32(),
+		Speed:      d.u16(),
+	}
+
+	return m, d.err
+}
+
+// DecodeWantHeartbeat reads the fields of a WantHeartbeat message, the message type already consumed
+func DecodeWantHeartbeat(r *bufio.Reader) (*WantHeartbeat, error) {
+	d := &decoder{r: r, msgType: MsgTypeWantHeartbeat}
+	m := &WantHeartbeat{Interval: d.u32()}
+
+	return m, d.err
+}
+
+// DecodeIAmCamera reads the fields of an IAmCamera message, the message type already consumed
+func DecodeIAmCamera(r *bufio.Reader) (*IAmCamera, error) {
+	d := &decoder{r: r, msgType: MsgTypeIAmCamera}
+	m := &IAmCamera{
+		Road:  d.u16(),
+		Mile:  d.u16(),
+		Limit: d.u16(),
+	}
+
+	return m, d.err
+}
+
+// DecodeIAmDispatcher reads the fields of an IAmDispatcher message, the message type already consumed
+func DecodeIAmDispatcher(r *bufio.Reader) (*IAmDispatcher, error) {
+	d := &decoder{r: r, msgType: MsgTypeIAmDispatcher}
+
+	numRoads := int(d.u8())
+	m := &IAmDispatcher{Roads: make([]uint16, 0, numRoads)}
+	for i := 0; i < numRoads && d.err == nil; i++ {
+		m.Roads = append(m.Roads, d.u16())
+	}
+
+	return m, d.err
+}
+
+func (m *Error) Encode(w *bufio.Writer) error {
+	if len(m.Msg) > 255 {
+		return ErrStringTooLong
+	}
+
+	e := &encoder{w: w}
+	e.u8(byte(MsgTypeError))
+	e.str(m.Msg)
+
+	return e.err
+}
+
+func (m *Plate) Encode(w *bufio.Writer) error {
+	if len(m.Plate) > 255 {
+		return ErrStringTooLong
+	}
+
+	e := &encoder{w: w}
+	e.u8(byte(MsgTypePlate))
+	e.str(m.Plate)
+	e.u32(m.Timestamp)
+
+	return e.err
+}
+
+func (m *Ticket) Encode(w *bufio.Writer) error {
+	if len(m.Plate) > 255 {
+		return ErrStringTooLong
+	}
+
+	e := &encoder{w: w}
+	e.u8(byte(MsgTypeTicket))
+	e.str(m.Plate)
+	e.u16(m.Road)
+	e.u16(m.Mile1)
+	e.u32(m.Timestamp1)
+	e.u16(m.Mile2)
+	e.u32(m.Timestamp2)
+	e.u16(m.Speed)
+
+	return e.err
+}
+
+func (m *WantHeartbeat) Encode(w *bufio.Writer) error {
+	e := &encoder{w: w}
+	e.u8(byte(MsgTypeWantHeartbeat))
+	e.u32(m.Interval)
+
+	return e.err
+}
+
+func (m *Heartbeat) Encode(w *bufio.Writer) error {
+	e := &encoder{w: w}
+	e.u8(byte(MsgTypeHeartbeat))
+
+	return e.err
+}
+
+func (m *IAmCamera) Encode(w *bufio.Writer) error {
+	e := &encoder{w: w}
+	e.u8(byte(MsgTypeIAmCamera))
+	e.u16(m.Road)
+	e.u16(m.Mile)
+	e.u16(m.Limit)
+
+	return e.err
+}
+
+func (m *IAmDispatcher) Encode(w *bufio.Writer) error {
+	if len(m.Roads) > 255 {
+		return ErrTooManyRoads
+	}
+
+	e := &encoder{w: w}
+	e.u8(byte(MsgTypeIAmDispatcher))
+	e.u8(byte(len(m.Roads)))
+	for _, road := range m.Roads {
+		e.u16(road)
+	}
+
+	return e.err
+}
+
+// decoder reads fields until the first error, which is kept in err
+type decoder struct {
+	r       *bufio.Reader
+	msgType MsgType
+	err     error
+}
+
+func (d *decoder) read(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	buf := make([]byte, n)
+	_, err := io.ReadFull(d.r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		d.err = fmt.Errorf("%s %w", d.msgType, ErrTruncated)
+		return nil
+	}
+	if err != nil {
+		d.err = errors.Wrapf(err, "failed to read %s", d.msgType)
+		return nil
+	}
+
+	return buf
+}
+
+func (d *decoder) u8() byte {
+	buf := d.read(1)
+	if buf == nil {
+		return 0
+	}
+
+	return buf[0]
+}
+
+func (d *decoder) u16() uint16 {
+	buf := d.read(2)
+	if buf == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(buf)
+}
+
+func (d *decoder) u32() uint32 {
+	buf := d.read(4)
+	if buf == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(buf)
+}
+
+func (d *decoder) str() string {
+	n := d.u8()
+	buf := d.read(int(n))
+	if buf == nil {
+		return ""
+	}
+
+	return string(buf)
+}
+
+// encoder writes fields until the first error, which is kept in err
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *encoder) write(buf []byte) {
+	if e.err != nil {
+		return
+	}
+
+	_, err := e.w.Write(buf)
+	if err != nil {
+		e.err = errors.Wrapf(err, "failed to write")
+	}
+}
+
+func (e *encoder) u8(v byte) {
+	e.write([]byte{v})
+}
+
+func (e *encoder) u16(v uint16) {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, v)
+	e.write(buf)
+}
+
+func (e *encoder) u32(v uint32) {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	e.write(buf)
+}
+
+// str expects a string of at most 255 bytes, checked by the callers before writing anything
+func (e *encoder) str(s string) {
+	e.u8(byte(len(s)))
+	e.write([]byte(s))
+}
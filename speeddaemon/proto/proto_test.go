@@ -0,0 +1,240 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeHex(t *testing.T, h string) (Message, error) {
+	buf, err := hex.DecodeString(h)
+	assert.NoError(t, err)
+
+	return Decode(bufio.NewReader(bytes.NewReader(buf)))
+}
+
+func encodeHex(t *testing.T, m Message) string {
+	buf := &bytes.Buffer{}
+	w := bufio.NewWriter(buf)
+
+	err := m.Encode(w)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Flush())
+
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func TestMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+		msg  Message
+	}{
+		{"Error", "1003626164", &Error{Msg: "bad"}},
+		{"Error2", "100b696c6c6567616c206d7367", &Error{Msg: "illegal msg"}},
+		{"Plate", "2004554e3158000003e8", &Plate{Plate: "UN1X", Timestamp: 1000}},
+		{"Plate2", "200752453035424b470001e240", &Plate{Plate: "RE05BKG", Timestamp: 123456}},
+		{"Ticket", "2104554e3158004200640001e240006e0001e3a82710", &Ticket{Plate: "UN1X", Road: 66, Mile1: 100, Timestamp1: 123456, Mile2: 110, Timestamp2: 123816, Speed: 10000}},
+		{"Ticket2", "210752453035424b47017004d2000f424004d3000f427c1770", &Ticket{Plate: "RE05BKG", Road: 368, Mile1: 1234, Timestamp1: 1000000, Mile2: 1235, Timestamp2: 1000060, Speed: 6000}},
+		{"WantHeartbeat", "400000000a", &WantHeartbeat{Interval: 10}},
+		{"WantHeartbeat2", "40000004db", &WantHeartbeat{Interval: 1243}},
+		{"Heartbeat", "41", &Heartbeat{}},
+		{"IAmCamera", "8000420064003c", &IAmCamera{Road: 66, Mile: 100, Limit: 60}},
+		{"IAmCamera2", "80017004d20028", &IAmCamera{Road: 368, Mile: 1234, Limit: 40}},
+		{"IAmDispatcher", "81010042", &IAmDispatcher{Roads: []uint16{66}}},
+		{"IAmDispatcher2", "8103004201701388", &IAmDispatcher{Roads: []uint16{66, 368, 5000}}},
+		{"IAmDispatcherNoRoads", "8100", &IAmDispatcher{Roads: []uint16{}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := decodeHex(t, tt.hex)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.msg, msg)
+
+			assert.Equal(t, tt.hex, encodeHex(t, tt.msg))
+		})
+	}
+}
+
+func TestDecodeError2(t *testing.T) {
+	// the Error example from the spec, "bad" then a trailing byte from the next message
+	buf, err := hex.DecodeString("10036261640141")
+	assert.NoError(t, err)
+
+	r := bufio.NewReader(bytes.NewReader(buf))
+	msg, err := Decode(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &Error{Msg: "bad"}, msg)
+
+	_, err = Decode(r)
+	assert.ErrorContains(t, err, "unknown message type 0x01")
+
+	msg, err = Decode(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &Heartbeat{}, msg)
+
+	_, err = Decode(r)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDecodeSequence(t *testing.T) {
+	buf, err := hex.DecodeString("8000420064003c" + "2004554e3158000003e8" + "400000000a")
+	assert.NoError(t, err)
+
+	r := bufio.NewReader(bytes.NewReader(buf))
+
+	msg, err := Decode(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &IAmCamera{Road: 66, Mile: 100, Limit: 60}, msg)
+
+	msg, err = Decode(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &Plate{Plate: "UN1X", Timestamp: 1000}, msg)
+
+	msg, err = Decode(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &WantHeartbeat{Interval: 10}, msg)
+
+	_, err = Decode(r)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDecodeUnknownMsgType(t *testing.T) {
+	for _, h := range []string{"00", "11", "42", "ff"} {
+		_, err := decodeHex(t, h)
+		assert.True(t, errors.Is(err, ErrUnknownMsgType))
+		assert.Equal(t, "unknown message type 0x"+h, err.Error())
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	tests := []struct {
+		hex string
+		err string
+	}{
+		{"10", "Error message truncated"},
+		{"10036261", "Error message truncated"},
+		{"2004554e31", "Plate message truncated"},
+		{"2004554e3158000003", "Plate message truncated"},
+		{"2104554e3158004200640001e240006e0001e3a827", "Ticket message truncated"},
+		{"40000000", "WantHeartbeat message truncated"},
+		{"8000420064", "IAmCamera message truncated"},
+		{"81", "IAmDispatcher message truncated"},
+		{"8102004201", "IAmDispatcher message truncated"},
+	}
+
+	for _, tt := range tests {
+		_, err := decodeHex(t, tt.hex)
+		assert.True(t, errors.Is(err, ErrTruncated), tt.hex)
+		assert.Equal(t, tt.err, err.Error())
+	}
+}
+
+func TestDecodeEmpty(t *testing.T) {
+	_, err := decodeHex(t, "")
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	w := bufio.NewWriter(&bytes.Buffer{})
+	long := string(bytes.Repeat([]byte("a"), 256))
+
+	assert.Equal(t, ErrStringTooLong, (&Error{Msg: long}).Encode(w))
+	assert.Equal(t, ErrStringTooLong, (&Plate{Plate: long}).Encode(w))
+	assert.Equal(t, ErrStringTooLong, (&Ticket{Plate: long}).Encode(w))
+	assert.Equal(t, ErrTooManyRoads, (&IAmDispatcher{Roads: make([]uint16, 256)}).Encode(w))
+	assert.Equal(t, 0, w.Buffered())
+}
+
+func TestMsgTypeString(t *testing.T) {
+	assert.Equal(t, "IAmDispatcher", MsgTypeIAmDispatcher.String())
+	assert.Equal(t, "0x12", MsgType(0x12).String())
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, h := range []string{
+		"100362616401",
+		"2004554e3158000003e8",
+		"2104554e3158004200640001e240006e0001e3a82710",
+		"400000000a",
+		"41",
+		"8000420064003c",
+		"8103004201701388",
+	} {
+		buf, _ := hex.DecodeString(h)
+		f.Add(buf)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+
+		msg, err := Decode(r)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, ErrTruncated) && !errors.Is(err, ErrUnknownMsgType) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			return
+		}
+
+		// a decoded message encodes back to the bytes it was read from
+		consumed := len(data) - r.Buffered()
+		buf := &bytes.Buffer{}
+		w := bufio.NewWriter(buf)
+		if err := msg.Encode(w); err != nil {
+			t.Fatalf("encode error %v", err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("flush error %v", err)
+		}
+
+		if !bytes.Equal(data[:consumed], buf.Bytes()) {
+			t.Fatalf("round trip mismatch %x != %x", data[:consumed], buf.Bytes())
+		}
+	})
+}
+
+func FuzzTicket(f *testing.F) {
+	f.Add("UN1X", uint16(66), uint16(100), uint32(123456), uint16(110), uint32(123816), uint16(10000))
+
+	f.Fuzz(func(t *testing.T, plate string, road, mile1 uint16, timestamp1 uint32, mile2 uint16, timestamp2 uint32, speed uint16) {
+		ticket := &Ticket{
+			Plate:      plate,
+			Road:       road,
+			Mile1:      mile1,
+			Timestamp1: timestamp1,
+			Mile2:      mile2,
+			Timestamp2: timestamp2,
+			Speed:      speed,
+		}
+
+		buf := &bytes.Buffer{}
+		w := bufio.NewWriter(buf)
+		err := ticket.Encode(w)
+		if len(plate) > 255 {
+			if err != ErrStringTooLong {
+				t.Fatalf("expected ErrStringTooLong, got %v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("encode error %v", err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("flush error %v", err)
+		}
+
+		msg, err := Decode(bufio.NewReader(buf))
+		if err != nil {
+			t.Fatalf("decode error %v", err)
+		}
+		if *msg.(*Ticket) != *ticket {
+			t.Fatalf("round trip mismatch %+v != %+v", msg, ticket)
+		}
+	})
+}
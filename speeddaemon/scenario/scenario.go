@@ -0,0 +1,304 @@
+// Package scenario drives a Speed Daemon server end to end: it plays plate observations
+// through simulated cameras and checks the tickets received by simulated dispatchers.
+package scenario
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/didil/protohackers/speeddaemon/proto"
+	"github.com/pkg/errors"
+)
+
+type Scenario struct {
+	Roads        []Road        `json:"roads"`
+	Dispatchers  []Dispatcher  `json:"dispatchers"`
+	Observations []Observation `json:"observations"`
+	// ExpectedTickets must all be received, and nothing else
+	ExpectedTickets []Ticket `json:"expectedTickets,omitempty"`
+	// ExpectedTicketedPlates must each receive exactly one ticket, whichever observations it covers
+	ExpectedTicketedPlates []string `json:"expectedTicketedPlates,omitempty"`
+}
+
+type Road struct {
+	Road  uint16 `json:"road"`
+	Limit uint16 `json:"limit"`
+	// Cameras are the miles of the cameras on the road
+	Cameras []uint16 `json:"cameras"`
+}
+
+type Dispatcher struct {
+	Roads []uint16 `json:"roads"`
+}
+
+// Observation is a plate seen by the camera at Mile on Road
+type Observation struct {
+	Road      uint16 `json:"road"`
+	Mile      uint16 `json:"mile"`
+	Plate     string `json:"plate"`
+	Timestamp uint32 `json:"timestamp"`
+}
+
+type Ticket struct {
+	Plate      string `json:"plate"`
+	Road       uint16 `json:"road"`
+	Mile1      uint16 `json:"mile1"`
+	Timestamp1 uint32 `json:"timestamp1"`
+	Mile2      uint16 `json:"mile2"`
+	Timestamp2 uint32 `json:"timestamp2"`
+	Speed      uint16 `json:"speed"`
+}
+
+func Load(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read scenario file")
+	}
+
+	sc := &Scenario{}
+	err = json.Unmarshal(data, sc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse scenario file")
+	}
+
+	return sc, nil
+}
+
+// Generate builds a scenario of numCars cars driving past numCameras cameras spread over numRoads roads.
+// Every other car drives above the limit and must receive a ticket
+func Generate(numCameras, numRoads, numCars int) (*Scenario, error) {
+	if numRoads < 1 {
+		return nil, errors.New("at least one road is needed")
+	}
+	if numCameras < 2*numRoads {
+		return nil, errors.New("at least two cameras per road are needed")
+	}
+
+	sc := &Scenario{}
+
+	limit := uint16(60)
+	for i := 0; i < numRoads; i++ {
+		sc.Roads = append(sc.Roads, Road{Road: uint16(i + 1), Limit: limit})
+	}
+	for i := 0; i < numCameras; i++ {
+		road := &sc.Roads[i%numRoads]
+		road.Cameras = append(road.Cameras, uint16(10*(i/numRoads)))
+	}
+
+	allRoads := []uint16{}
+	for _, road := range sc.Roads {
+		allRoads = append(allRoads, road.Road)
+	}
+	sc.Dispatchers = []Dispatcher{{Roads: allRoads}}
+
+	for i := 0; i < numCars; i++ {
+		road := sc.Roads[i%numRoads]
+		plate := fmt.Sprintf("CAR%04d", i)
+
+		speed := 50
+		if i%2 == 1 {
+			speed = 100
+			sc.ExpectedTicketedPlates = append(sc.ExpectedTicketedPlates, plate)
+		}
+
+		timestamp := uint32(10 * i)
+		for j, mile := range road.Cameras {
+			if j > 0 {
+				timestamp += uint32(int(mile-road.Cameras[j-1]) * 3600 / speed)
+			}
+			sc.Observations = append(sc.Observations, Observation{Road: road.Road, Mile: mile, Plate: plate, Timestamp: timestamp})
+		}
+	}
+
+	sort.SliceStable(sc.Observations, func(i, j int) bool {
+		return sc.Observations[i].Timestamp < sc.Observations[j].Timestamp
+	})
+
+	return sc, nil
+}
+
+func (sc *Scenario) numExpectedTickets() int {
+	return len(sc.ExpectedTickets) + len(sc.ExpectedTicketedPlates)
+}
+
+type cameraKey struct {
+	road uint16
+	mile uint16
+}
+
+// Run plays the scenario against the server at addr and returns the tickets received by the dispatchers.
+// It returns once the expected number of tickets is received, or waits until ctx is done otherwise
+func Run(ctx context.Context, addr string, sc *Scenario) ([]Ticket, error) {
+	conns := []net.Conn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	dial := func() (net.Conn, *bufio.Writer, error) {
+		d := &net.Dialer{}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to connect to %s", addr)
+		}
+		conns = append(conns, conn)
+
+		return conn, bufio.NewWriter(conn), nil
+	}
+
+	send := func(w *bufio.Writer, m proto.Message) error {
+		err := m.Encode(w)
+		if err != nil {
+			return err
+		}
+
+		return errors.Wrapf(w.Flush(), "failed to send %s", m.Type())
+	}
+
+	lock := &sync.Mutex{}
+	tickets := []Ticket{}
+	received := make(chan bool, 1)
+	readErrs := make(chan error, len(sc.Dispatchers))
+
+	for _, dispatcher := range sc.Dispatchers {
+		conn, w, err := dial()
+		if err != nil {
+			return nil, err
+		}
+
+		err = send(w, &proto.IAmDispatcher{Roads: dispatcher.Roads})
+		if err != nil {
+			return nil, err
+		}
+
+		go func() {
+			r := bufio.NewReader(conn)
+			for {
+				msg, err := proto.Decode(r)
+				if err != nil {
+					readErrs <- err
+					return
+				}
+
+				switch m := msg.(type) {
+				case *proto.Ticket:
+					lock.Lock()
+					tickets = append(tickets, Ticket(*m))
+					lock.Unlock()
+
+					select {
+					case received <- true:
+					default:
+					}
+				case *proto.Error:
+					readErrs <- fmt.Errorf("dispatcher received error: %s", m.Msg)
+					return
+				}
+			}
+		}()
+	}
+
+	cameras := map[cameraKey]*bufio.Writer{}
+	for _, road := range sc.Roads {
+		for _, mile := range road.Cameras {
+			_, w, err := dial()
+			if err != nil {
+				return nil, err
+			}
+
+			err = send(w, &proto.IAmCamera{Road: road.Road, Mile: mile, Limit: road.Limit})
+			if err != nil {
+				return nil, err
+			}
+
+			cameras[cameraKey{road: road.Road, mile: mile}] = w
+		}
+	}
+
+	for _, o := range sc.Observations {
+		w := cameras[cameraKey{road: o.Road, mile: o.Mile}]
+		if w == nil {
+			return nil, fmt.Errorf("no camera at mile %d on road %d", o.Mile, o.Road)
+		}
+
+		err := send(w, &proto.Plate{Plate: o.Plate, Timestamp: o.Timestamp})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		lock.Lock()
+		n := len(tickets)
+		lock.Unlock()
+
+		if sc.numExpectedTickets() > 0 && n >= sc.numExpectedTickets() {
+			// leave a little time for unexpected extra tickets
+			time.Sleep(100 * time.Millisecond)
+			break
+		}
+
+		select {
+		case <-received:
+			continue
+		case err := <-readErrs:
+			return nil, err
+		case <-ctx.Done():
+		}
+		break
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	return append([]Ticket{}, tickets...), nil
+}
+
+// Verify checks the received tickets against the scenario expectations
+func (sc *Scenario) Verify(tickets []Ticket) error {
+	if len(tickets) != sc.numExpectedTickets() {
+		return fmt.Errorf("expected %d tickets, received %d", sc.numExpectedTickets(), len(tickets))
+	}
+
+	remaining := append([]Ticket{}, tickets...)
+
+	for _, expected := range sc.ExpectedTickets {
+		i := indexOfTicket(remaining, func(t Ticket) bool { return t == expected })
+		if i < 0 {
+			return fmt.Errorf("expected ticket not received: %+v", expected)
+		}
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+
+	for _, plate := range sc.ExpectedTicketedPlates {
+		i := indexOfTicket(remaining, func(t Ticket) bool { return t.Plate == plate })
+		if i < 0 {
+			return fmt.Errorf("expected ticket not received for plate %s", plate)
+		}
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+
+	if len(remaining) > 0 {
+		return fmt.Errorf("unexpected ticket received: %+v", remaining[0])
+	}
+
+	return nil
+}
+
+func indexOfTicket(tickets []Ticket, match func(t Ticket) bool) int {
+	for i, t := range tickets {
+		if match(t) {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,100 @@
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/didil/protohackers/server"
+	"github.com/didil/protohackers/services"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// port differs from the server package tests which run in parallel
+const testPort = 35100
+
+func startSpeedDaemon(t *testing.T) chan bool {
+	logger, err := zap.NewDevelopment()
+	assert.NoError(t, err)
+
+	s, err := server.NewServer(server.ProtoHackersModeSpeedDaemon, testPort, logger,
+		server.WithSpeedDaemonDbService(services.NewSpeedDaemonService()),
+	)
+	assert.NoError(t, err)
+
+	done := make(chan bool, 1)
+
+	go func() {
+		err := s.Start(done)
+		assert.NoError(t, err)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	return done
+}
+
+func TestRunExample(t *testing.T) {
+	done := startSpeedDaemon(t)
+
+	sc, err := Load("testdata/example.json")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tickets, err := Run(ctx, fmt.Sprintf("127.0.0.1:%d", testPort), sc)
+	assert.NoError(t, err)
+
+	assert.NoError(t, sc.Verify(tickets))
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestRunGenerated(t *testing.T) {
+	done := startSpeedDaemon(t)
+
+	sc, err := Generate(12, 4, 200)
+	assert.NoError(t, err)
+	assert.Len(t, sc.ExpectedTicketedPlates, 100)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tickets, err := Run(ctx, fmt.Sprintf("127.0.0.1:%d", testPort), sc)
+	assert.NoError(t, err)
+
+	assert.NoError(t, sc.Verify(tickets))
+
+	done <- true
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestGenerateInvalid(t *testing.T) {
+	_, err := Generate(3, 2, 10)
+	assert.ErrorContains(t, err, "at least two cameras per road are needed")
+
+	_, err = Generate(3, 0, 10)
+	assert.ErrorContains(t, err, "at least one road is needed")
+}
+
+func TestVerify(t *testing.T) {
+	sc := &Scenario{
+		ExpectedTickets: []Ticket{
+			{Plate: "UN1X", Road: 123, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45, Speed: 8000},
+		},
+		ExpectedTicketedPlates: []string{"RE05BKG"},
+	}
+
+	expected := Ticket{Plate: "UN1X", Road: 123, Mile1: 8, Timestamp1: 0, Mile2: 9, Timestamp2: 45, Speed: 8000}
+	other := Ticket{Plate: "RE05BKG", Road: 456, Mile1: 0, Timestamp1: 0, Mile2: 10, Timestamp2: 360, Speed: 10000}
+
+	assert.NoError(t, sc.Verify([]Ticket{other, expected}))
+
+	assert.EqualError(t, sc.Verify([]Ticket{expected}), "expected 2 tickets, received 1")
+	assert.EqualError(t, sc.Verify([]Ticket{other, other}), "expected ticket not received: {Plate:UN1X Road:123 Mile1:8 Timestamp1:0 Mile2:9 Timestamp2:45 Speed:8000}")
+	assert.EqualError(t, sc.Verify([]Ticket{expected, expected}), "expected ticket not received for plate RE05BKG")
+}